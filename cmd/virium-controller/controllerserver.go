@@ -19,49 +19,137 @@ package main
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/kubernetes-csi/csi-lib-utils/protosanitizer"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 	"google.golang.org/protobuf/types/known/timestamppb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
 	klog "k8s.io/klog/v2"
 )
 
+// Volume context keys consumed by the iSCSI node plugin (getISCSIInfo),
+// CreateVolume always sets the ones down to volCtxInitiatorName
+const (
+	// JSON list of the target portals, each with a port
+	volCtxPortals = "portals"
+	// First target portal, host:port
+	volCtxTargetPortal = "targetPortal"
+	volCtxIQN          = "iqn"
+	volCtxLUN          = "lun"
+	// iSCSI iface the session is bound to, "default" unless the StorageClass sets one
+	volCtxInterface = "iscsiInterface"
+	// "true" when discovery, resp. session, CHAP authentication is required
+	volCtxDiscoveryCHAPAuth = "discoveryCHAPAuth"
+	volCtxSessionCHAPAuth   = "sessionCHAPAuth"
+	// Initiator allowed by the backend when the volume was created
+	volCtxInitiatorName = "initiatorName"
+	// Optional keys, only set when the StorageClass has the matching parameter
+	volCtxMkfsOptions = "mkfsOptions"
+	volCtxPool        = "pool"
+	// "sendtargets" or "static", how the node finds the target before login
+	volCtxDiscovery = "discovery"
+	// Seconds, set as node.conn[0].timeo.noop_out_interval and noop_out_timeout
+	volCtxNoopOutInterval = "noopOutInterval"
+	volCtxNoopOutTimeout  = "noopOutTimeout"
+	// StorageClass parameter giving the port of portals that don't carry one,
+	// it is folded into volCtxPortals and volCtxTargetPortal
+	volCtxTargetPort = "targetPort"
+)
+
+// StorageClass parameters only sent to the backend
+const (
+	paramPool      = "pool"
+	paramQosPolicy = "qosPolicy"
+	// Set by the external-provisioner when it runs with --extra-create-metadata
+	paramPVCName      = "csi.storage.k8s.io/pvc/name"
+	paramPVCNamespace = "csi.storage.k8s.io/pvc/namespace"
+	// Pre-provisioned target used as is instead of asking the backend for a volume
+	paramExistingTarget = "existingTarget"
+	paramExistingIQN    = "existingIQN"
+	paramExistingLUN    = "existingLUN"
+)
+
+// VolumeAttributesClass parameters, with paramQosPolicy they are the only
+// ones ControllerModifyVolume changes on an existing volume
+const (
+	// Maximum I/O operations per second, 0 for unlimited
+	paramIopsLimit = "iopsLimit"
+	// Maximum bytes per second, 0 for unlimited
+	paramBandwidthLimit = "bandwidthLimit"
+)
+
+// staticVolumePrefix marks the IDs of volumes built on a pre-provisioned target,
+// the backend knows nothing about them. The colon keeps it apart from any backend
+// ID, CreateVolume refuses a backend volume whose ID carries the prefix
+const staticVolumePrefix = "static:"
+
 type ControllerServer struct {
-	Driver *driver
+	Driver      *driver
+	volumeLocks *VolumeLocks
 	csi.UnimplementedControllerServer
 }
 
 // Volume Request :
 type VolumeRequest struct {
-	InitiatorName string               `json:"initiator_name"`
-	Capacity      int64                `json:"capacity"`
-	ContentSource *VolumeContentSource `json:"content_source,omitempty"`
-}
-type VolumeContentSource struct {
-	Type struct {
-		Snapshot *SnapshotSource `json:"Snapshot,omitempty"`
-		Volume   *VolumeSource   `json:"Volume,omitempty"`
-	} `json:"Type"`
-}
-type SnapshotSource struct {
-	SnapshotID string `json:"snapshot_id"`
-}
-type VolumeSource struct {
-	VolumeID string `json:"volume_id"`
+	Name           string `json:"name"`
+	PVCName        string `json:"pvc_name,omitempty"`
+	PVCNamespace   string `json:"pvc_namespace,omitempty"`
+	InitiatorName  string `json:"initiator_name"`
+	Capacity       int64  `json:"capacity"`
+	SnapshotID     string `json:"snapshot_id,omitempty"`
+	SourceVolumeID string `json:"source_volume_id,omitempty"`
+	Pool           string `json:"pool,omitempty"`
+	QosPolicy      string `json:"qos_policy,omitempty"`
+	IopsLimit      *int64 `json:"iops_limit,omitempty"`
+	BandwidthLimit *int64 `json:"bandwidth_limit,omitempty"`
+	// Topology segments the volume must, then should, be reachable from
+	RequisiteTopology []map[string]string `json:"requisite_topology,omitempty"`
+	PreferredTopology []map[string]string `json:"preferred_topology,omitempty"`
 }
 
 // Volume Request ^^
 
 type VolumeResponse struct {
-	VolumeID          string `json:"volume_id"`
-	TargetPortal      string `json:"targetPortal"`
-	Iqn               string `json:"iqn"`
-	Lun               string `json:"lun"`
-	DiscoveryCHAPAuth string `json:"discoveryCHAPAuth"`
-	SessionCHAPAuth   string `json:"sessionCHAPAuth"`
+	VolumeID           string               `json:"volume_id"`
+	Name               string               `json:"name,omitempty"`
+	TargetPortal       string               `json:"targetPortal"`
+	Iqn                string               `json:"iqn"`
+	Lun                string               `json:"lun"`
+	DiscoveryCHAPAuth  string               `json:"discoveryCHAPAuth"`
+	SessionCHAPAuth    string               `json:"sessionCHAPAuth"`
+	Capacity           int64                `json:"capacity"`
+	PublishedNodeIDs   []string             `json:"published_node_ids,omitempty"`
+	AccessibleTopology []map[string]string  `json:"accessible_topology,omitempty"`
+	Condition          *VolumeConditionInfo `json:"condition,omitempty"`
+	QosPolicy          string               `json:"qos_policy,omitempty"`
+	IopsLimit          *int64               `json:"iops_limit,omitempty"`
+	BandwidthLimit     *int64               `json:"bandwidth_limit,omitempty"`
+	// Content source the volume was created from, if any
+	SnapshotID     string `json:"snapshot_id,omitempty"`
+	SourceVolumeID string `json:"source_volume_id,omitempty"`
+	// Nodes the volume is attached to, with the publish context of each attach
+	Attachments []VolumeAttachment `json:"attachments,omitempty"`
+}
+
+type VolumeAttachment struct {
+	NodeID         string            `json:"node_id"`
+	InitiatorName  string            `json:"initiator_name,omitempty"`
+	PublishContext map[string]string `json:"publish_context,omitempty"`
+}
+
+type VolumeConditionInfo struct {
+	Abnormal bool   `json:"abnormal"`
+	Message  string `json:"message"`
 }
 
 type DeleteVolumeRequest struct {
@@ -73,53 +161,165 @@ type VolumeResizeRequest struct {
 	Capacity int64  `json:"capacity"`
 }
 
+// VolumeModifyRequest is the body of PATCH /api/volumes/{id}, empty fields are left unchanged
+type VolumeModifyRequest struct {
+	QosPolicy      string `json:"qos_policy,omitempty"`
+	IopsLimit      *int64 `json:"iops_limit,omitempty"`
+	BandwidthLimit *int64 `json:"bandwidth_limit,omitempty"`
+}
+
 type SnapshotRequest struct {
 	Name     string `json:"name"`
 	VolumeID string `json:"source_volume_id"`
 }
 
 type SnapshotResponse struct {
-	VolumeID string `json:"snapshot_id"`
-	Capacity int64  `json:"capacity"`
+	VolumeID       string    `json:"snapshot_id"`
+	Name           string    `json:"name,omitempty"`
+	Capacity       int64     `json:"capacity"`
+	SourceVolumeID string    `json:"source_volume_id"`
+	CreationTime   time.Time `json:"creation_time"`
+	ReadyToUse     *bool     `json:"ready_to_use,omitempty"`
 }
 
 type DeleteSnapshotRequest struct {
 	SnapshotID string `json:"snapshot_id"`
 }
 
+type AttachRequest struct {
+	NodeID        string `json:"node_id"`
+	InitiatorName string `json:"initiator_name"`
+	// Whether the volume may stay attached to other nodes, a single-node
+	// volume already attached elsewhere is refused with 409 Conflict
+	MultiAttach bool `json:"multi_attach,omitempty"`
+}
+
+type AttachResponse struct {
+	PublishContext map[string]string `json:"publish_context,omitempty"`
+}
+
+type CapacityResponse struct {
+	AvailableCapacity int64  `json:"available_capacity"`
+	MaximumVolumeSize *int64 `json:"maximum_volume_size,omitempty"`
+	MinimumVolumeSize *int64 `json:"minimum_volume_size,omitempty"`
+}
+
 func (cs *ControllerServer) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest) (*csi.CreateVolumeResponse, error) {
-	klog.V(1).Info("Creating Volume via API for:", req.Name)
+	logger := klog.FromContext(ctx)
+	if len(req.GetName()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume name missing in request")
+	}
+	logger.V(1).Info("Creating Volume via API", "name", req.Name)
+
+	lockKey := volumeNameLockKey(backendVolumeName(req.GetName()))
+	if !cs.volumeLocks.TryAcquire(lockKey) {
+		return nil, status.Errorf(codes.Aborted, volumeOperationAlreadyExistsFmt, req.GetName())
+	}
+	defer cs.volumeLocks.Release(lockKey)
+
+	if err := isValidVolumeCapabilities(ctx, req.GetVolumeCapabilities()); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if err := validateParameters(ctx, req.GetParameters()); err != nil {
+		return nil, err
+	}
+	if err := validateMutableParameters(req.GetMutableParameters()); err != nil {
+		return nil, err
+	}
+	for _, c := range req.GetVolumeCapabilities() {
+		if err := validateFsType(c.GetMount().GetFsType()); err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+	}
+
+	capacity, err := getRequestCapacity(req.GetCapacityRange())
+	if err != nil {
+		return nil, err
+	}
+	capacity, err = roundVolumeSize(capacity, req.GetCapacityRange())
+	if err != nil {
+		return nil, err
+	}
+	if err := checkMaxVolumeSize(capacity); err != nil {
+		return nil, err
+	}
+	src := req.VolumeContentSource
+
+	// Pre-provisioned targets skip the backend altogether
+	if hasStaticTarget(req.GetParameters()) {
+		return newStaticCreateVolumeResponse(req, capacity, cs.Driver)
+	}
+	name := backendVolumeName(req.GetName())
+
+	// A retried call must return the volume provisioned by the first one
+	existing, err := cs.getVolumeByName(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if existing != nil {
+		// Backends that don't report the size are assumed to have granted the request
+		if existing.Capacity > 0 && !isCapacityInRange(existing.Capacity, req.GetCapacityRange()) {
+			return nil, status.Errorf(codes.AlreadyExists, "volume %s already exists with incompatible capacity %d", req.GetName(), existing.Capacity)
+		}
+		if !isSameContentSource(existing, src) {
+			return nil, status.Errorf(codes.AlreadyExists, "volume %s already exists with a different content source", req.GetName())
+		}
+		if err := validateBackendVolume(existing); err != nil {
+			return nil, err
+		}
+		logger.V(1).Info("Volume already exists", "name", req.Name)
+		return newCreateVolumeResponse(existing, capacity, src, req.GetParameters(), cs.Driver), nil
+	}
 
 	// Step 1: Prepare request payload
-	apiURL := fmt.Sprintf("%s/api/volumes/create", cs.Driver.apiURL)
+	apiPath := "/api/volumes/create"
 	payload := VolumeRequest{
-		InitiatorName: cs.Driver.initiatorName,
-		Capacity:      req.CapacityRange.RequiredBytes,
+		Name:              name,
+		PVCName:           req.GetParameters()[paramPVCName],
+		PVCNamespace:      req.GetParameters()[paramPVCNamespace],
+		InitiatorName:     cs.Driver.initiatorName,
+		Capacity:          capacity,
+		Pool:              req.GetParameters()[paramPool],
+		QosPolicy:         req.GetParameters()[paramQosPolicy],
+		RequisiteTopology: topologySegments(req.GetAccessibilityRequirements().GetRequisite()),
+		PreferredTopology: topologySegments(req.GetAccessibilityRequirements().GetPreferred()),
+	}
+	// A VolumeAttributesClass given at creation takes precedence over the StorageClass
+	if mutable := req.GetMutableParameters(); len(mutable) > 0 {
+		modify := newVolumeModifyRequest(mutable)
+		if modify.QosPolicy != "" {
+			payload.QosPolicy = modify.QosPolicy
+		}
+		payload.IopsLimit = modify.IopsLimit
+		payload.BandwidthLimit = modify.BandwidthLimit
 	}
-	src := req.VolumeContentSource
 	if src != nil {
-		klog.V(5).Info("Content source requested", src)
+		logger.V(5).Info("Content source requested", "source", src)
 		switch src := req.VolumeContentSource.Type.(type) {
 		case *csi.VolumeContentSource_Snapshot:
-			payload.ContentSource = &VolumeContentSource{
-				Type: struct {
-					Snapshot *SnapshotSource `json:"Snapshot,omitempty"`
-					Volume   *VolumeSource   `json:"Volume,omitempty"`
-				}{
-					Snapshot: &SnapshotSource{SnapshotID: src.Snapshot.SnapshotId},
-				},
+			snapshotID := src.Snapshot.GetSnapshotId()
+			snap, err := cs.getSnapshot(ctx, snapshotID)
+			if err != nil {
+				return nil, err
 			}
+			if capacity < snap.Capacity {
+				return nil, status.Errorf(codes.OutOfRange, "requested capacity %d is smaller than snapshot %s size %d", capacity, snapshotID, snap.Capacity)
+			}
+			apiPath = "/api/volumes/create-from-snapshot"
+			payload.SnapshotID = snapshotID
 		case *csi.VolumeContentSource_Volume:
-			payload.ContentSource = &VolumeContentSource{
-				Type: struct {
-					Snapshot *SnapshotSource `json:"Snapshot,omitempty"`
-					Volume   *VolumeSource   `json:"Volume,omitempty"`
-				}{
-					Volume: &VolumeSource{VolumeID: src.Volume.VolumeId},
-				},
+			sourceVolumeID := src.Volume.GetVolumeId()
+			sourceVol, err := cs.getVolume(ctx, sourceVolumeID)
+			if err != nil {
+				return nil, err
+			}
+			if capacity < sourceVol.Capacity {
+				return nil, status.Errorf(codes.OutOfRange, "requested capacity %d is smaller than source volume %s size %d", capacity, sourceVolumeID, sourceVol.Capacity)
 			}
+			apiPath = "/api/volumes/clone"
+			payload.SourceVolumeID = sourceVolumeID
 		default:
-			fmt.Println("ContentSource Unknown type:", src)
+			return nil, status.Errorf(codes.InvalidArgument, "unsupported volume content source: %v", src)
 		}
 	}
 
@@ -128,9 +328,18 @@ func (cs *ControllerServer) CreateVolume(ctx context.Context, req *csi.CreateVol
 		return nil, fmt.Errorf("failed to marshal request: %v", err)
 	}
 
-	resp, err := viriumHttpClient("POST", apiURL, jsonData)
+	// Backends provisioning asynchronously answer with a job to wait for
+	release, err := cs.Driver.writes.acquire(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("API request failed: %v", err)
+		return nil, err
+	}
+	resp, err := cs.Driver.viriumJobRequest(ctx, "POST", apiPath, jsonData)
+	release()
+	if err != nil {
+		if src != nil && isNotFound(err) {
+			return nil, status.Errorf(codes.NotFound, "volume content source not found: %v", err)
+		}
+		return nil, apiStatusError("API request failed", err)
 	}
 
 	var volResp VolumeResponse
@@ -138,52 +347,213 @@ func (cs *ControllerServer) CreateVolume(ctx context.Context, req *csi.CreateVol
 		return nil, fmt.Errorf("failed to parse volume response: %v", err)
 	}
 
+	if err := validateBackendVolume(&volResp); err != nil {
+		return nil, err
+	}
+
+	cs.Driver.volumes.putVolume(ctx, name, volResp.VolumeID)
+	logger.V(1).Info("Volume created successfully", "name", req.Name, "backendName", name, "volumeID", volResp.VolumeID)
+
+	// Step 4: Return CSI-compatible volume response
+	ret_value := newCreateVolumeResponse(&volResp, capacity, src, req.GetParameters(), cs.Driver)
+	logger.V(1).Info("Volume creation payload", "volumeID", ret_value.Volume.VolumeId, "capacity", ret_value.Volume.CapacityBytes, "volumeContext", redactSecrets(ret_value.Volume.VolumeContext))
+	return ret_value, nil
+
+}
+
+// topologySegments flattens CSI topologies into the segment maps sent to the backend
+func topologySegments(topologies []*csi.Topology) []map[string]string {
+	var segments []map[string]string
+	for _, t := range topologies {
+		segments = append(segments, t.GetSegments())
+	}
+	return segments
+}
+
+// getVolumeByName looks up a backend volume by its CSI name,
+// it returns nil when no such volume exists
+func (cs *ControllerServer) getVolumeByName(ctx context.Context, name string) (*VolumeResponse, error) {
+	if volumeID, ok := cs.Driver.volumes.volumeID(name); ok {
+		volResp, err := cs.getVolume(ctx, volumeID)
+		if err == nil {
+			return volResp, nil
+		}
+		if status.Code(err) != codes.NotFound {
+			return nil, err
+		}
+		cs.Driver.volumes.removeVolume(ctx, volumeID)
+	}
+
+	apiPath := fmt.Sprintf("/api/volumes/by-name/%s", url.PathEscape(name))
+	resp, err := cs.Driver.viriumHttpClient(ctx, "GET", apiPath, nil)
+	if err != nil {
+		if isNotFound(err) {
+			return nil, nil
+		}
+		return nil, apiStatusError("API request failed", err)
+	}
+
+	var volResp VolumeResponse
+	if err := json.NewDecoder(bytes.NewReader(resp)).Decode(&volResp); err != nil {
+		return nil, fmt.Errorf("failed to parse volume response: %v", err)
+	}
+	return &volResp, nil
+}
+
+// isSameContentSource reports whether an existing volume was created from the requested source
+func isSameContentSource(vol *VolumeResponse, src *csi.VolumeContentSource) bool {
+	return vol.SnapshotID == src.GetSnapshot().GetSnapshotId() && vol.SourceVolumeID == src.GetVolume().GetVolumeId()
+}
+
+func hasStaticTarget(params map[string]string) bool {
+	return params[paramExistingTarget] != "" || params[paramExistingIQN] != "" || params[paramExistingLUN] != ""
+}
+
+func isStaticVolume(volumeID string) bool {
+	return strings.HasPrefix(volumeID, staticVolumePrefix)
+}
+
+// validateBackendVolume checks what the node plugin and the later calls rely on
+// in a backend volume, a failure is the backend's fault
+func validateBackendVolume(vol *VolumeResponse) error {
+	if isStaticVolume(vol.VolumeID) {
+		return status.Errorf(codes.Internal, "backend volume ID %s clashes with the %q prefix of pre-provisioned volumes", vol.VolumeID, staticVolumePrefix)
+	}
+	if err := validateLUN(vol.Lun); err != nil {
+		return status.Errorf(codes.Internal, "volume %s: %v", vol.VolumeID, err)
+	}
+	if err := validateIQN(vol.Iqn); err != nil {
+		return status.Errorf(codes.Internal, "volume %s: %v", vol.VolumeID, err)
+	}
+	return nil
+}
+
+// newStaticCreateVolumeResponse builds the CSI volume of a pre-provisioned target,
+// its ID derives from the name so that a retried call returns the same volume
+func newStaticCreateVolumeResponse(req *csi.CreateVolumeRequest, capacity int64, d *driver) (*csi.CreateVolumeResponse, error) {
+	params := req.GetParameters()
+	if params[paramExistingTarget] == "" || params[paramExistingIQN] == "" || params[paramExistingLUN] == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "%s, %s and %s must be set together", paramExistingTarget, paramExistingIQN, paramExistingLUN)
+	}
+	if req.GetVolumeContentSource() != nil {
+		return nil, status.Error(codes.InvalidArgument, "a pre-provisioned target can't have a volume content source")
+	}
+
+	volResp := &VolumeResponse{
+		VolumeID:     staticVolumePrefix + req.GetName(),
+		TargetPortal: params[paramExistingTarget],
+		Iqn:          params[paramExistingIQN],
+		Lun:          params[paramExistingLUN],
+	}
+	return newCreateVolumeResponse(volResp, capacity, nil, params, d), nil
+}
+
+// newCreateVolumeResponse builds the CSI volume, with the context consumed by the node plugin
+func newCreateVolumeResponse(volResp *VolumeResponse, capacity int64, src *csi.VolumeContentSource, params map[string]string, d *driver) *csi.CreateVolumeResponse {
+	// The StorageClass targetPort wins over the driver-wide default port
+	defaultPort := *iscsiDefaultPort
+	if port := params[volCtxTargetPort]; port != "" {
+		defaultPort = port
+	}
+	targetPortal := normalizePortal(volResp.TargetPortal, defaultPort)
+
+	// The iSCSI iface the node binds the session to, e.g. for VLAN separation
+	iscsiInterface := "default"
+	if iface := params[volCtxInterface]; iface != "" {
+		iscsiInterface = iface
+	}
 	portals := []string{}
-	portals = append(portals, volResp.TargetPortal)
+	portals = append(portals, targetPortal)
 	portalList, _ := json.Marshal(portals)
 
-	klog.V(1).Info("Volume created successfully", req.Name)
+	// The backend may provision more than requested, backends that don't
+	// report the size are assumed to have granted the request
+	if volResp.Capacity > 0 {
+		capacity = volResp.Capacity
+	}
 
-	// Step 4: Return CSI-compatible volume response
 	ret_value := &csi.CreateVolumeResponse{
 		Volume: &csi.Volume{
 			VolumeId:      volResp.VolumeID,
-			CapacityBytes: req.CapacityRange.RequiredBytes,
+			CapacityBytes: capacity,
 			VolumeContext: map[string]string{
-				"portals":           string(portalList), // portal: "[]"
-				"targetPortal":      volResp.TargetPortal,
-				"iqn":               volResp.Iqn,
-				"lun":               volResp.Lun,
-				"interface":         "default",
-				"discoveryCHAPAuth": volResp.DiscoveryCHAPAuth,
-				"sessionCHAPAuth":   volResp.SessionCHAPAuth,
+				volCtxPortals:           string(portalList), // portal: "[]"
+				volCtxTargetPortal:      targetPortal,
+				volCtxIQN:               volResp.Iqn,
+				volCtxLUN:               volResp.Lun,
+				volCtxInterface:         iscsiInterface,
+				volCtxDiscoveryCHAPAuth: volResp.DiscoveryCHAPAuth,
+				volCtxSessionCHAPAuth:   volResp.SessionCHAPAuth,
+				volCtxInitiatorName:     d.initiatorName,
 			},
 		},
 	}
-	if src != nil {
-		ret_value.Volume.ContentSource = &csi.VolumeContentSource{
-			Type: &csi.VolumeContentSource_Volume{
-				Volume: &csi.VolumeContentSource_VolumeSource{
-					VolumeId: src.GetVolume().GetVolumeId(),
-				},
-			},
+	// CHAP toggles forced by the StorageClass win over the backend defaults
+	for _, key := range []string{volCtxDiscoveryCHAPAuth, volCtxSessionCHAPAuth} {
+		if value := params[key]; value != "" {
+			ret_value.Volume.VolumeContext[key] = value
 		}
 	}
-
-	klog.V(1).Infof("Volume creation payload %+v\n", ret_value)
-	return ret_value, nil
-
+	for _, segments := range volResp.AccessibleTopology {
+		ret_value.Volume.AccessibleTopology = append(ret_value.Volume.AccessibleTopology, &csi.Topology{Segments: segments})
+	}
+	// Without backend topology the volume is tagged with the network of its portal
+	if len(ret_value.Volume.AccessibleTopology) == 0 {
+		if segments := d.portalTopology.segments(targetPortal); segments != nil {
+			ret_value.Volume.AccessibleTopology = []*csi.Topology{{Segments: segments}}
+		}
+	}
+	if pool := params[paramPool]; pool != "" {
+		ret_value.Volume.VolumeContext[volCtxPool] = pool
+	}
+	for _, key := range []string{volCtxDiscovery, volCtxNoopOutInterval, volCtxNoopOutTimeout} {
+		if value := params[key]; value != "" {
+			ret_value.Volume.VolumeContext[key] = value
+		}
+	}
+	// Format options only apply when the node formats a blank device
+	if mkfsOptions := params[volCtxMkfsOptions]; mkfsOptions != "" {
+		ret_value.Volume.VolumeContext[volCtxMkfsOptions] = mkfsOptions
+	}
+	if src != nil {
+		ret_value.Volume.ContentSource = src
+	}
+	return ret_value
 }
 
 func (cs *ControllerServer) DeleteVolume(ctx context.Context, req *csi.DeleteVolumeRequest) (*csi.DeleteVolumeResponse, error) {
+	logger := klog.FromContext(ctx)
 	volumeID := req.GetVolumeId()
 	if volumeID == "" {
-		return nil, fmt.Errorf("volume ID is required")
+		return nil, status.Error(codes.InvalidArgument, "Volume ID is required for deletion")
+	}
+	logger.V(1).Info("Deleting Volume via API", "volumeID", volumeID)
+
+	lockKey := cs.volumeLockKey(volumeID)
+	if !cs.volumeLocks.TryAcquire(lockKey) {
+		return nil, status.Errorf(codes.Aborted, volumeOperationAlreadyExistsFmt, volumeID)
+	}
+	defer cs.volumeLocks.Release(lockKey)
+
+	// The backing target of a static volume belongs to the operator
+	if isStaticVolume(volumeID) {
+		logger.V(1).Info("Static volume deleted, its target is left in place", "volumeID", volumeID)
+		return &csi.DeleteVolumeResponse{}, nil
+	}
+
+	// Deleting an attached volume could force-detach it under a running pod
+	if !*forceDelete {
+		vol, err := cs.getVolume(ctx, volumeID)
+		if err != nil && status.Code(err) != codes.NotFound {
+			return nil, err
+		}
+		if vol != nil && len(vol.PublishedNodeIDs) > 0 {
+			return nil, status.Errorf(codes.FailedPrecondition, "volume %s is still published on nodes %v", volumeID, vol.PublishedNodeIDs)
+		}
 	}
-	klog.V(1).Info("Deleting Volume via API:", volumeID)
 
 	// Step 1: Prepare request payload
-	apiURL := fmt.Sprintf("%s/api/volumes/delete", cs.Driver.apiURL)
+	apiPath := "/api/volumes/delete"
 	payload := DeleteVolumeRequest{
 		VolumeID: volumeID,
 	}
@@ -192,29 +562,159 @@ func (cs *ControllerServer) DeleteVolume(ctx context.Context, req *csi.DeleteVol
 		return nil, fmt.Errorf("failed to marshal request: %v", err)
 	}
 
-	_, err = viriumHttpClient("DELETE", apiURL, jsonData)
+	// A volume that is already gone is deleted
+	release, err := cs.Driver.writes.acquire(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("API request failed: %v", err)
+		return nil, err
+	}
+	_, err = cs.Driver.viriumHttpClient(ctx, "DELETE", apiPath, jsonData)
+	release()
+	if err != nil {
+		if !isNotFound(err) {
+			return nil, apiStatusError(fmt.Sprintf("failed to delete volume %s", volumeID), err)
+		}
+		logger.V(2).Info("Volume not found on the backend, assuming already deleted", "volumeID", volumeID)
 	}
 
-	klog.V(1).Info("Volume successfully deleted", volumeID)
+	cs.Driver.volumes.removeVolume(ctx, volumeID)
+	logger.V(1).Info("Volume successfully deleted", "volumeID", volumeID)
 	return &csi.DeleteVolumeResponse{}, nil
 }
 
 func (cs *ControllerServer) ControllerPublishVolume(ctx context.Context, req *csi.ControllerPublishVolumeRequest) (*csi.ControllerPublishVolumeResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "")
+	logger := klog.FromContext(ctx)
+	if len(req.GetVolumeId()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
+	}
+	if len(req.GetNodeId()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Node ID missing in request")
+	}
+	if req.GetVolumeCapability() == nil {
+		return nil, status.Error(codes.InvalidArgument, "Volume capability missing in request")
+	}
+	logger.V(1).Info("Attaching Volume via API", "volumeID", req.GetVolumeId(), "nodeID", req.GetNodeId())
+
+	// The operator manages the ACL of a pre-provisioned target
+	if isStaticVolume(req.GetVolumeId()) {
+		return &csi.ControllerPublishVolumeResponse{}, nil
+	}
+
+	// The target ACL allows the initiator of the publishing node
+	initiator, err := nodeInitiator(req.GetNodeId(), cs.Driver.initiatorName)
+	if err != nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "node %s: %v", req.GetNodeId(), err)
+	}
+
+	apiPath := fmt.Sprintf("/api/volumes/%s/attach", url.PathEscape(req.GetVolumeId()))
+	payload := AttachRequest{
+		NodeID:        req.GetNodeId(),
+		InitiatorName: initiator,
+		MultiAttach:   !isSingleNodeMode(req.GetVolumeCapability().GetAccessMode().GetMode()),
+	}
+	jsonData, err := json.Marshal(payload)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal request: %v", err)
+	}
+
+	resp, err := cs.Driver.viriumHttpClient(ctx, "POST", apiPath, jsonData)
+	if err != nil {
+		var apiErr *apiError
+		if errors.As(err, &apiErr) && apiErr.statusCode == http.StatusConflict {
+			return cs.publishedVolume(ctx, req, apiErr)
+		}
+		if isNotFound(err) {
+			return nil, status.Errorf(codes.NotFound, "volume %s not found", req.GetVolumeId())
+		}
+		return nil, apiStatusError("API request failed", err)
+	}
+
+	var attachResp AttachResponse
+	if len(resp) > 0 {
+		if err := json.NewDecoder(bytes.NewReader(resp)).Decode(&attachResp); err != nil {
+			return nil, fmt.Errorf("failed to parse attach response: %v", err)
+		}
+	}
+
+	logger.V(1).Info("Volume successfully attached", "volumeID", req.GetVolumeId(), "nodeID", req.GetNodeId())
+	return &csi.ControllerPublishVolumeResponse{
+		PublishContext: attachResp.PublishContext,
+	}, nil
+}
+
+// publishedVolume resolves an attach refused with 409 Conflict: a retry for a node
+// the volume is already attached to gets the publish context of the first call,
+// a single-node volume attached to another node can't be published
+func (cs *ControllerServer) publishedVolume(ctx context.Context, req *csi.ControllerPublishVolumeRequest, conflict *apiError) (*csi.ControllerPublishVolumeResponse, error) {
+	vol, err := cs.getVolume(ctx, req.GetVolumeId())
+	if err != nil {
+		return nil, err
+	}
+	for _, a := range vol.Attachments {
+		if a.NodeID == req.GetNodeId() {
+			klog.FromContext(ctx).V(1).Info("Volume already attached", "volumeID", req.GetVolumeId(), "nodeID", req.GetNodeId())
+			return &csi.ControllerPublishVolumeResponse{PublishContext: a.PublishContext}, nil
+		}
+	}
+	// Backends that don't report attachments give no publish context either
+	for _, node := range vol.PublishedNodeIDs {
+		if node == req.GetNodeId() {
+			klog.FromContext(ctx).V(1).Info("Volume already attached", "volumeID", req.GetVolumeId(), "nodeID", req.GetNodeId())
+			return &csi.ControllerPublishVolumeResponse{}, nil
+		}
+	}
+	if isSingleNodeMode(req.GetVolumeCapability().GetAccessMode().GetMode()) {
+		return nil, status.Errorf(codes.FailedPrecondition, "volume %s is already published on another node: %v", req.GetVolumeId(), conflict)
+	}
+	return nil, status.Errorf(codes.Aborted, "failed to attach volume %s: %v", req.GetVolumeId(), conflict)
 }
 
 func (cs *ControllerServer) ControllerUnpublishVolume(ctx context.Context, req *csi.ControllerUnpublishVolumeRequest) (*csi.ControllerUnpublishVolumeResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "")
+	logger := klog.FromContext(ctx)
+	if len(req.GetVolumeId()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
+	}
+	logger.V(1).Info("Detaching Volume via API", "volumeID", req.GetVolumeId(), "nodeID", req.GetNodeId())
+
+	if isStaticVolume(req.GetVolumeId()) {
+		return &csi.ControllerUnpublishVolumeResponse{}, nil
+	}
+
+	apiPath := fmt.Sprintf("/api/volumes/%s/detach", url.PathEscape(req.GetVolumeId()))
+	payload := AttachRequest{
+		NodeID: req.GetNodeId(),
+	}
+	jsonData, err := json.Marshal(payload)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal request: %v", err)
+	}
+
+	// A volume or attachment that is already gone is detached
+	if _, err := cs.Driver.viriumHttpClient(ctx, "POST", apiPath, jsonData); err != nil && !isNotFound(err) {
+		return nil, apiStatusError("API request failed", err)
+	}
+
+	logger.V(1).Info("Volume successfully detached", "volumeID", req.GetVolumeId(), "nodeID", req.GetNodeId())
+	return &csi.ControllerUnpublishVolumeResponse{}, nil
 }
 
 func (cs *ControllerServer) ValidateVolumeCapabilities(ctx context.Context, req *csi.ValidateVolumeCapabilitiesRequest) (*csi.ValidateVolumeCapabilitiesResponse, error) {
 	if len(req.GetVolumeId()) == 0 {
 		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
 	}
-	if err := isValidVolumeCapabilities(req.GetVolumeCapabilities()); err != nil {
-		return nil, status.Error(codes.InvalidArgument, err.Error())
+	if len(req.GetVolumeCapabilities()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume capabilities missing in request")
+	}
+	if !isStaticVolume(req.GetVolumeId()) {
+		if _, err := cs.getVolume(ctx, req.GetVolumeId()); err != nil {
+			return nil, err
+		}
+	}
+
+	// Confirm only when every requested capability is supported
+	if err := isValidVolumeCapabilities(ctx, req.GetVolumeCapabilities()); err != nil {
+		return &csi.ValidateVolumeCapabilitiesResponse{
+			Message: err.Error(),
+		}, nil
 	}
 
 	return &csi.ValidateVolumeCapabilitiesResponse{
@@ -226,17 +726,130 @@ func (cs *ControllerServer) ValidateVolumeCapabilities(ctx context.Context, req
 }
 
 func (cs *ControllerServer) ListVolumes(ctx context.Context, req *csi.ListVolumesRequest) (*csi.ListVolumesResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "")
+	logger := klog.FromContext(ctx)
+	if req.GetMaxEntries() < 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "Negative max entries %d in request", req.GetMaxEntries())
+	}
+	after, err := parseListToken(req.GetStartingToken(), listSortVolumes)
+	if err != nil {
+		return nil, err
+	}
+	logger.V(5).Info("Listing volumes via API", "after", after, "maxEntries", req.GetMaxEntries())
+
+	// Resuming after a volume deleted since the previous page would silently skip entries
+	if after != "" {
+		if _, err := cs.getVolume(ctx, after); err != nil {
+			if status.Code(err) == codes.NotFound {
+				return nil, status.Errorf(codes.Aborted, "starting token volume %s no longer exists", after)
+			}
+			return nil, err
+		}
+	}
+
+	volumes, err := cs.listVolumes(ctx, after, int(req.GetMaxEntries()))
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]*csi.ListVolumesResponse_Entry, 0, len(volumes))
+	for _, vol := range volumes {
+		entries = append(entries, &csi.ListVolumesResponse_Entry{
+			Volume: &csi.Volume{
+				VolumeId:      vol.VolumeID,
+				CapacityBytes: vol.Capacity,
+			},
+		})
+	}
+
+	// A full page means there may be more volumes to fetch
+	nextToken := ""
+	if req.GetMaxEntries() > 0 && len(entries) == int(req.GetMaxEntries()) {
+		nextToken = encodeListToken(listSortVolumes, volumes[len(volumes)-1].VolumeID)
+	}
+
+	return &csi.ListVolumesResponse{
+		Entries:   entries,
+		NextToken: nextToken,
+	}, nil
+}
+
+// listVolumes fetches the page of backend volumes following the after ID,
+// a zero limit fetches them all
+func (cs *ControllerServer) listVolumes(ctx context.Context, after string, limit int) ([]VolumeResponse, error) {
+	query := url.Values{}
+	query.Set("sort", listSortVolumes)
+	if after != "" {
+		query.Set("after", after)
+	}
+	if limit > 0 {
+		query.Set("limit", strconv.Itoa(limit))
+	}
+	apiPath := "/api/volumes/list?" + query.Encode()
+
+	resp, err := cs.Driver.viriumHttpClient(ctx, "GET", apiPath, nil)
+	if err != nil {
+		return nil, apiStatusError("API request failed", err)
+	}
+
+	var volumes []VolumeResponse
+	if err := json.NewDecoder(bytes.NewReader(resp)).Decode(&volumes); err != nil {
+		return nil, fmt.Errorf("failed to parse volume list response: %v", err)
+	}
+	return volumes, nil
 }
 
 func (cs *ControllerServer) GetCapacity(ctx context.Context, req *csi.GetCapacityRequest) (*csi.GetCapacityResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "")
+	logger := klog.FromContext(ctx)
+	// The pool parameter and topology segments let the backend select the pool,
+	// other StorageClass parameters don't affect the capacity
+	query := url.Values{}
+	if pool := req.GetParameters()[paramPool]; pool != "" {
+		query.Set(paramPool, pool)
+	}
+	for k, v := range req.GetAccessibleTopology().GetSegments() {
+		query.Set(k, v)
+	}
+	apiPath := "/api/capacity"
+	if len(query) > 0 {
+		apiPath = fmt.Sprintf("%s?%s", apiPath, query.Encode())
+	}
+
+	resp, err := cs.Driver.viriumHttpClient(ctx, "GET", apiPath, nil)
+	if err != nil {
+		// Only a pool the backend doesn't know has no capacity, a 404 without the
+		// envelope comes from a backend that has no capacity endpoint at all
+		var apiErr *apiError
+		if errors.As(err, &apiErr) && apiErr.code == "not_found" {
+			logger.V(2).Info("No storage pool matches parameters, reporting no capacity", "pool", req.GetParameters()[paramPool])
+			return &csi.GetCapacityResponse{AvailableCapacity: 0}, nil
+		}
+		if errors.As(err, &apiErr) && apiErr.statusCode == http.StatusNotFound {
+			return nil, status.Errorf(codes.Unimplemented, "the Virium api doesn't report capacity: %v", apiErr)
+		}
+		return nil, apiStatusError("API request failed", err)
+	}
+
+	var capResp CapacityResponse
+	if err := json.NewDecoder(bytes.NewReader(resp)).Decode(&capResp); err != nil {
+		return nil, fmt.Errorf("failed to parse capacity response: %v", err)
+	}
+
+	ret_value := &csi.GetCapacityResponse{
+		AvailableCapacity: capResp.AvailableCapacity,
+	}
+	if capResp.MaximumVolumeSize != nil {
+		ret_value.MaximumVolumeSize = wrapperspb.Int64(*capResp.MaximumVolumeSize)
+	}
+	if capResp.MinimumVolumeSize != nil {
+		ret_value.MinimumVolumeSize = wrapperspb.Int64(*capResp.MinimumVolumeSize)
+	}
+	return ret_value, nil
 }
 
 // ControllerGetCapabilities implements the default GRPC callout.
 // Default supports all capabilities.
 func (cs *ControllerServer) ControllerGetCapabilities(ctx context.Context, req *csi.ControllerGetCapabilitiesRequest) (*csi.ControllerGetCapabilitiesResponse, error) {
-	klog.V(5).Infof("Using default ControllerGetCapabilities")
+	klog.FromContext(ctx).V(5).Info("Using default ControllerGetCapabilities")
 
 	return &csi.ControllerGetCapabilitiesResponse{
 		Capabilities: cs.Driver.cscap,
@@ -244,52 +857,135 @@ func (cs *ControllerServer) ControllerGetCapabilities(ctx context.Context, req *
 }
 
 func (cs *ControllerServer) CreateSnapshot(ctx context.Context, req *csi.CreateSnapshotRequest) (*csi.CreateSnapshotResponse, error) {
-	klog.V(1).Info("Creating snapshot via API for:", req.Name)
+	logger := klog.FromContext(ctx)
+	if len(req.GetName()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Snapshot name missing in request")
+	}
+	if len(req.GetSourceVolumeId()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Snapshot source volume ID missing in request")
+	}
+	logger.V(1).Info("Creating snapshot via API", "name", req.GetName(), "sourceVolumeID", req.GetSourceVolumeId())
+	if isStaticVolume(req.GetSourceVolumeId()) {
+		return nil, status.Errorf(codes.FailedPrecondition, "volume %s is a pre-provisioned target and can't be snapshotted", req.GetSourceVolumeId())
+	}
+
+	lockKey := snapshotNameLockKey(req.GetName())
+	if !cs.volumeLocks.TryAcquire(lockKey) {
+		return nil, status.Errorf(codes.Aborted, volumeOperationAlreadyExistsFmt, req.GetName())
+	}
+	defer cs.volumeLocks.Release(lockKey)
+
+	// A retried call must return the snapshot created by the first one
+	existing, err := cs.getSnapshotByName(ctx, req.GetName())
+	if err != nil {
+		return nil, err
+	}
+	if existing != nil {
+		if existing.SourceVolumeID != "" && existing.SourceVolumeID != req.GetSourceVolumeId() {
+			return nil, status.Errorf(codes.AlreadyExists, "snapshot %s already exists for source volume %s", req.GetName(), existing.SourceVolumeID)
+		}
+		cs.Driver.volumes.putSnapshot(ctx, req.GetName(), existing.VolumeID, req.GetSourceVolumeId())
+		logger.V(1).Info("Snapshot already exists", "snapshotID", existing.VolumeID)
+		return newCreateSnapshotResponse(existing, req.GetSourceVolumeId()), nil
+	}
 
 	// Step 1: Prepare request payload
-	apiURL := fmt.Sprintf("%s/api/snapshot/create", cs.Driver.apiURL)
+	apiPath := "/api/snapshot/create"
 	payload := SnapshotRequest{
-		VolumeID: req.SourceVolumeId,
-		Name:     req.Name,
+		VolumeID: req.GetSourceVolumeId(),
+		Name:     req.GetName(),
 	}
 	jsonData, err := json.Marshal(payload)
 	if err != nil {
 		return nil, fmt.Errorf("failed to marshal request: %v", err)
 	}
 
-	resp, err := viriumHttpClient("POST", apiURL, jsonData)
+	// An asynchronous snapshot is waited for, so it is ready to use once the
+	// job completed unless its result says otherwise
+	release, err := cs.Driver.writes.acquire(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("API request failed: %v", err)
+		return nil, err
+	}
+	resp, err := cs.Driver.viriumJobRequest(ctx, "POST", apiPath, jsonData)
+	release()
+	if err != nil {
+		return nil, apiStatusError("API request failed", err)
 	}
 
 	var volResp SnapshotResponse
 	if err := json.NewDecoder(bytes.NewReader(resp)).Decode(&volResp); err != nil {
 		return nil, fmt.Errorf("failed to parse volume response: %v", err)
 	}
-	klog.V(1).Info("Snapshot created successfully, snapshotId:", volResp.VolumeID)
+	cs.Driver.volumes.putSnapshot(ctx, req.GetName(), volResp.VolumeID, req.GetSourceVolumeId())
+	logger.V(1).Info("Snapshot created successfully", "snapshotID", volResp.VolumeID)
 	// Step 4: Return CSI-compatible volume response
+	return newCreateSnapshotResponse(&volResp, req.GetSourceVolumeId()), nil
+}
+
+// getSnapshotByName looks up a backend snapshot by its CSI name,
+// it returns nil when no such snapshot exists
+func (cs *ControllerServer) getSnapshotByName(ctx context.Context, name string) (*SnapshotResponse, error) {
+	apiPath := fmt.Sprintf("/api/snapshot/by-name/%s", url.PathEscape(name))
+	resp, err := cs.Driver.viriumHttpClient(ctx, "GET", apiPath, nil)
+	if err != nil {
+		if isNotFound(err) {
+			return nil, nil
+		}
+		return nil, apiStatusError("API request failed", err)
+	}
+
+	var snapResp SnapshotResponse
+	if err := json.NewDecoder(bytes.NewReader(resp)).Decode(&snapResp); err != nil {
+		return nil, fmt.Errorf("failed to parse snapshot response: %v", err)
+	}
+	return &snapResp, nil
+}
+
+// getSnapshot fetches a backend snapshot by id, a missing snapshot is reported as codes.NotFound
+func (cs *ControllerServer) getSnapshot(ctx context.Context, snapshotID string) (*SnapshotResponse, error) {
+	apiPath := fmt.Sprintf("/api/snapshot/%s", url.PathEscape(snapshotID))
+	resp, err := cs.Driver.viriumHttpClient(ctx, "GET", apiPath, nil)
+	if err != nil {
+		if isNotFound(err) {
+			return nil, status.Errorf(codes.NotFound, "snapshot %s not found", snapshotID)
+		}
+		return nil, apiStatusError("API request failed", err)
+	}
+
+	var snapResp SnapshotResponse
+	if err := json.NewDecoder(bytes.NewReader(resp)).Decode(&snapResp); err != nil {
+		return nil, fmt.Errorf("failed to parse snapshot response: %v", err)
+	}
+	return &snapResp, nil
+}
+
+// newCreateSnapshotResponse reports a pending backend snapshot as not ready
+// so that the snapshot sidecar keeps polling until it is
+func newCreateSnapshotResponse(snap *SnapshotResponse, sourceVolumeID string) *csi.CreateSnapshotResponse {
+	if snap.SourceVolumeID == "" {
+		snap.SourceVolumeID = sourceVolumeID
+	}
 	return &csi.CreateSnapshotResponse{
-		Snapshot: &csi.Snapshot{
-			SnapshotId:     volResp.VolumeID,
-			SourceVolumeId: req.Name,
-			CreationTime:   timestamppb.Now(),
-			ReadyToUse:     true,
-			SizeBytes:      volResp.Capacity,
-		},
-	}, nil
+		Snapshot: newCSISnapshot(snap),
+	}
 }
 
 func (cs *ControllerServer) DeleteSnapshot(ctx context.Context, req *csi.DeleteSnapshotRequest) (*csi.DeleteSnapshotResponse, error) {
-	klog.V(5).Infof("Delete snap req: %+v", req)
-	klog.V(5).Infof("Delete snap snapId %s", req.SnapshotId)
-	klog.V(5).Infof("Delete snap Secret %+v", req.GetSecrets())
+	logger := klog.FromContext(ctx)
+	logger.V(5).Info("Delete snap req", "request", protosanitizer.StripSecrets(req))
 	if len(req.GetSnapshotId()) == 0 {
 		return nil, status.Error(codes.InvalidArgument, "Snapshot ID is required for deletion")
 	}
-	klog.V(1).Info("Deleting Volume via API:", req.SnapshotId)
+	logger.V(1).Info("Deleting snapshot via API", "snapshotID", req.SnapshotId)
+
+	lockKey := cs.snapshotLockKey(req.GetSnapshotId())
+	if !cs.volumeLocks.TryAcquire(lockKey) {
+		return nil, status.Errorf(codes.Aborted, volumeOperationAlreadyExistsFmt, req.GetSnapshotId())
+	}
+	defer cs.volumeLocks.Release(lockKey)
 
 	// Step 1: Prepare request payload
-	apiURL := fmt.Sprintf("%s/api/snapshot/delete", cs.Driver.apiURL)
+	apiPath := "/api/snapshot/delete"
 	payload := DeleteSnapshotRequest{
 		SnapshotID: req.SnapshotId,
 	}
@@ -298,20 +994,122 @@ func (cs *ControllerServer) DeleteSnapshot(ctx context.Context, req *csi.DeleteS
 		return nil, fmt.Errorf("failed to marshal request: %v", err)
 	}
 
-	_, err = viriumHttpClient("DELETE", apiURL, jsonData)
+	// A snapshot that is already gone is deleted
+	release, err := cs.Driver.writes.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	_, err = cs.Driver.viriumHttpClient(ctx, "DELETE", apiPath, jsonData)
+	release()
 	if err != nil {
-		return nil, fmt.Errorf("API request failed: %v", err)
+		if !isNotFound(err) {
+			return nil, apiStatusError(fmt.Sprintf("failed to delete snapshot %s", req.GetSnapshotId()), err)
+		}
+		logger.V(2).Info("Snapshot not found on the backend, assuming already deleted", "snapshotID", req.SnapshotId)
 	}
 
-	klog.V(1).Info("Snapshot successfully deleted:", req.SnapshotId)
+	cs.Driver.volumes.removeSnapshot(ctx, req.GetSnapshotId())
+	logger.V(1).Info("Snapshot successfully deleted", "snapshotID", req.SnapshotId)
 	return &csi.DeleteSnapshotResponse{}, nil
 }
 
 func (cs *ControllerServer) ListSnapshots(ctx context.Context, req *csi.ListSnapshotsRequest) (*csi.ListSnapshotsResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "")
+	logger := klog.FromContext(ctx)
+	if req.GetMaxEntries() < 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "Negative max entries %d in request", req.GetMaxEntries())
+	}
+	after, err := parseListToken(req.GetStartingToken(), listSortSnapshots)
+	if err != nil {
+		return nil, err
+	}
+	logger.V(5).Info("Listing snapshots via API", "after", after, "maxEntries", req.GetMaxEntries())
+
+	// Resuming after a snapshot deleted since the previous page would silently skip entries
+	if after != "" {
+		if _, err := cs.getSnapshot(ctx, after); err != nil {
+			if status.Code(err) == codes.NotFound {
+				return nil, status.Errorf(codes.Aborted, "starting token snapshot %s no longer exists", after)
+			}
+			return nil, err
+		}
+	}
+
+	query := url.Values{}
+	query.Set("sort", listSortSnapshots)
+	if after != "" {
+		query.Set("after", after)
+	}
+	if req.GetMaxEntries() > 0 {
+		query.Set("limit", strconv.Itoa(int(req.GetMaxEntries())))
+	}
+	if req.GetSourceVolumeId() != "" {
+		query.Set("source_volume_id", req.GetSourceVolumeId())
+	}
+	if req.GetSnapshotId() != "" {
+		query.Set("snapshot_id", req.GetSnapshotId())
+	}
+	snapshots, err := cs.listSnapshots(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]*csi.ListSnapshotsResponse_Entry, 0, len(snapshots))
+	for i := range snapshots {
+		entries = append(entries, &csi.ListSnapshotsResponse_Entry{
+			Snapshot: newCSISnapshot(&snapshots[i]),
+		})
+	}
+
+	// A full page means there may be more snapshots to fetch
+	nextToken := ""
+	if req.GetMaxEntries() > 0 && len(entries) == int(req.GetMaxEntries()) {
+		nextToken = encodeListToken(listSortSnapshots, snapshots[len(snapshots)-1].VolumeID)
+	}
+
+	return &csi.ListSnapshotsResponse{
+		Entries:   entries,
+		NextToken: nextToken,
+	}, nil
+}
+
+// listSnapshots fetches the backend snapshots matching the given query filters
+func (cs *ControllerServer) listSnapshots(ctx context.Context, query url.Values) ([]SnapshotResponse, error) {
+	apiPath := fmt.Sprintf("/api/snapshot/list?%s", query.Encode())
+
+	resp, err := cs.Driver.viriumHttpClient(ctx, "GET", apiPath, nil)
+	if err != nil {
+		return nil, apiStatusError("API request failed", err)
+	}
+
+	var snapshots []SnapshotResponse
+	if err := json.NewDecoder(bytes.NewReader(resp)).Decode(&snapshots); err != nil {
+		return nil, fmt.Errorf("failed to parse snapshot list response: %v", err)
+	}
+	return snapshots, nil
+}
+
+// newCSISnapshot converts a backend snapshot, a backend that doesn't report
+// readiness or creation time is assumed to have completed the snapshot now
+func newCSISnapshot(snap *SnapshotResponse) *csi.Snapshot {
+	readyToUse := true
+	if snap.ReadyToUse != nil {
+		readyToUse = *snap.ReadyToUse
+	}
+	creationTime := timestamppb.Now()
+	if !snap.CreationTime.IsZero() {
+		creationTime = timestamppb.New(snap.CreationTime)
+	}
+	return &csi.Snapshot{
+		SnapshotId:     snap.VolumeID,
+		SourceVolumeId: snap.SourceVolumeID,
+		CreationTime:   creationTime,
+		ReadyToUse:     readyToUse,
+		SizeBytes:      snap.Capacity,
+	}
 }
 
 func (cs *ControllerServer) ControllerExpandVolume(ctx context.Context, req *csi.ControllerExpandVolumeRequest) (*csi.ControllerExpandVolumeResponse, error) {
+	logger := klog.FromContext(ctx)
 	if len(req.GetVolumeId()) == 0 {
 		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
 	}
@@ -319,10 +1117,45 @@ func (cs *ControllerServer) ControllerExpandVolume(ctx context.Context, req *csi
 	if req.GetCapacityRange() == nil {
 		return nil, status.Error(codes.InvalidArgument, "Capacity Range missing in request")
 	}
-	klog.V(1).Info("Expand Volume", req.GetVolumeId())
-	volSizeBytes := int64(req.GetCapacityRange().GetRequiredBytes())
+	logger.V(1).Info("Expand Volume", "volumeID", req.GetVolumeId())
+
+	lockKey := cs.volumeLockKey(req.GetVolumeId())
+	if !cs.volumeLocks.TryAcquire(lockKey) {
+		return nil, status.Errorf(codes.Aborted, volumeOperationAlreadyExistsFmt, req.GetVolumeId())
+	}
+	defer cs.volumeLocks.Release(lockKey)
+	volSizeBytes, err := roundVolumeSize(req.GetCapacityRange().GetRequiredBytes(), req.GetCapacityRange())
+	if err != nil {
+		return nil, err
+	}
+	if err := checkMaxVolumeSize(volSizeBytes); err != nil {
+		return nil, err
+	}
+	if isStaticVolume(req.GetVolumeId()) {
+		return nil, status.Errorf(codes.FailedPrecondition, "volume %s is a pre-provisioned target and can't be expanded", req.GetVolumeId())
+	}
+
+	// Shrinking an iSCSI LUN under a filesystem is unsafe, and a volume that
+	// already has the requested size needs no backend call
+	current, err := cs.getVolume(ctx, req.GetVolumeId())
+	if err != nil {
+		return nil, err
+	}
+	if current.Capacity > 0 {
+		if req.GetCapacityRange().GetRequiredBytes() < current.Capacity {
+			return nil, status.Errorf(codes.InvalidArgument, "volume %s can't shrink from %d bytes to %d bytes", req.GetVolumeId(), current.Capacity, req.GetCapacityRange().GetRequiredBytes())
+		}
+		if volSizeBytes <= current.Capacity {
+			logger.V(2).Info("Volume already has the requested size", "volumeID", req.GetVolumeId(), "capacity", current.Capacity)
+			return &csi.ControllerExpandVolumeResponse{
+				CapacityBytes:         current.Capacity,
+				NodeExpansionRequired: req.GetVolumeCapability().GetBlock() == nil,
+			}, nil
+		}
+	}
+
 	// Step 1: Prepare request payload
-	apiURL := fmt.Sprintf("%s/api/volumes/resize", cs.Driver.apiURL)
+	apiPath := "/api/volumes/resize"
 	payload := VolumeResizeRequest{
 		VolumeID: req.GetVolumeId(),
 		Capacity: volSizeBytes,
@@ -332,9 +1165,10 @@ func (cs *ControllerServer) ControllerExpandVolume(ctx context.Context, req *csi
 		return nil, fmt.Errorf("failed to marshal request: %v", err)
 	}
 
-	resp, err := viriumHttpClient("POST", apiURL, jsonData)
+	// An asynchronous resize is waited for, its result carries the final size
+	resp, err := cs.Driver.viriumJobRequest(ctx, "POST", apiPath, jsonData)
 	if err != nil {
-		return nil, fmt.Errorf("API request failed: %v", err)
+		return nil, apiStatusError("API request failed", err)
 	}
 
 	var volResp VolumeResponse
@@ -342,11 +1176,123 @@ func (cs *ControllerServer) ControllerExpandVolume(ctx context.Context, req *csi
 		return nil, fmt.Errorf("failed to parse volume response: %v", err)
 	}
 
-	klog.V(1).Infof("Expand Volume %s successfully, currentQuota: %d bytes", req.VolumeId, volSizeBytes)
+	// Backends that don't report the new size are assumed to have granted the request
+	newSizeBytes := volResp.Capacity
+	if newSizeBytes == 0 {
+		newSizeBytes = volSizeBytes
+	}
+	if newSizeBytes < volSizeBytes {
+		return nil, status.Errorf(codes.Internal, "volume %s expanded to %d bytes, less than the requested %d bytes", req.GetVolumeId(), newSizeBytes, volSizeBytes)
+	}
+
+	logger.V(1).Info("Expand Volume successfully", "volumeID", req.VolumeId, "currentQuota", newSizeBytes)
 
-	return &csi.ControllerExpandVolumeResponse{CapacityBytes: req.GetCapacityRange().GetRequiredBytes()}, nil
+	// Raw block volumes have no filesystem to grow on the node
+	return &csi.ControllerExpandVolumeResponse{
+		CapacityBytes:         newSizeBytes,
+		NodeExpansionRequired: req.GetVolumeCapability().GetBlock() == nil,
+	}, nil
+}
+
+func (cs *ControllerServer) ControllerModifyVolume(ctx context.Context, req *csi.ControllerModifyVolumeRequest) (*csi.ControllerModifyVolumeResponse, error) {
+	logger := klog.FromContext(ctx)
+	if len(req.GetVolumeId()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
+	}
+	if err := validateMutableParameters(req.GetMutableParameters()); err != nil {
+		return nil, err
+	}
+	logger.V(1).Info("Modify Volume", "volumeID", req.GetVolumeId(), "parameters", req.GetMutableParameters())
+
+	lockKey := cs.volumeLockKey(req.GetVolumeId())
+	if !cs.volumeLocks.TryAcquire(lockKey) {
+		return nil, status.Errorf(codes.Aborted, volumeOperationAlreadyExistsFmt, req.GetVolumeId())
+	}
+	defer cs.volumeLocks.Release(lockKey)
+	if isStaticVolume(req.GetVolumeId()) {
+		return nil, status.Errorf(codes.FailedPrecondition, "volume %s is a pre-provisioned target and can't be modified", req.GetVolumeId())
+	}
+	if len(req.GetMutableParameters()) == 0 {
+		return &csi.ControllerModifyVolumeResponse{}, nil
+	}
+
+	apiPath := fmt.Sprintf("/api/volumes/%s", url.PathEscape(req.GetVolumeId()))
+	jsonData, err := json.Marshal(newVolumeModifyRequest(req.GetMutableParameters()))
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal request: %v", err)
+	}
+	resp, err := cs.Driver.viriumJobRequest(ctx, "PATCH", apiPath, jsonData)
+	if err != nil {
+		if isNotFound(err) {
+			return nil, status.Errorf(codes.NotFound, "volume %s not found", req.GetVolumeId())
+		}
+		return nil, apiStatusError(fmt.Sprintf("failed to modify volume %s", req.GetVolumeId()), err)
+	}
+
+	// The response carries nothing back, the updated volume is only logged
+	if len(resp) > 0 {
+		var volResp VolumeResponse
+		if err := json.NewDecoder(bytes.NewReader(resp)).Decode(&volResp); err != nil {
+			return nil, fmt.Errorf("failed to parse volume response: %v", err)
+		}
+		logger.V(1).Info("Modify Volume successfully", "volumeID", req.GetVolumeId(), "qosPolicy", volResp.QosPolicy, "iopsLimit", volResp.IopsLimit, "bandwidthLimit", volResp.BandwidthLimit)
+	} else {
+		logger.V(1).Info("Modify Volume successfully", "volumeID", req.GetVolumeId())
+	}
+	return &csi.ControllerModifyVolumeResponse{}, nil
 }
 
 func (cs *ControllerServer) ControllerGetVolume(ctx context.Context, req *csi.ControllerGetVolumeRequest) (*csi.ControllerGetVolumeResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "")
+	logger := klog.FromContext(ctx)
+	if len(req.GetVolumeId()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
+	}
+	logger.V(5).Info("Get Volume via API", "volumeID", req.GetVolumeId())
+
+	if isStaticVolume(req.GetVolumeId()) {
+		return &csi.ControllerGetVolumeResponse{
+			Volume: &csi.Volume{VolumeId: req.GetVolumeId()},
+			Status: &csi.ControllerGetVolumeResponse_VolumeStatus{VolumeCondition: &csi.VolumeCondition{}},
+		}, nil
+	}
+
+	volResp, err := cs.getVolume(ctx, req.GetVolumeId())
+	if err != nil {
+		return nil, err
+	}
+
+	volStatus := &csi.ControllerGetVolumeResponse_VolumeStatus{
+		PublishedNodeIds: volResp.PublishedNodeIDs,
+		VolumeCondition:  &csi.VolumeCondition{},
+	}
+	if volResp.Condition != nil {
+		volStatus.VolumeCondition.Abnormal = volResp.Condition.Abnormal
+		volStatus.VolumeCondition.Message = volResp.Condition.Message
+	}
+
+	return &csi.ControllerGetVolumeResponse{
+		Volume: &csi.Volume{
+			VolumeId:      volResp.VolumeID,
+			CapacityBytes: volResp.Capacity,
+		},
+		Status: volStatus,
+	}, nil
+}
+
+// getVolume fetches a backend volume by id, a missing volume is reported as codes.NotFound
+func (cs *ControllerServer) getVolume(ctx context.Context, volumeID string) (*VolumeResponse, error) {
+	apiPath := fmt.Sprintf("/api/volumes/%s", url.PathEscape(volumeID))
+	resp, err := cs.Driver.viriumHttpClient(ctx, "GET", apiPath, nil)
+	if err != nil {
+		if isNotFound(err) {
+			return nil, status.Errorf(codes.NotFound, "volume %s not found", volumeID)
+		}
+		return nil, apiStatusError("API request failed", err)
+	}
+
+	var volResp VolumeResponse
+	if err := json.NewDecoder(bytes.NewReader(resp)).Decode(&volResp); err != nil {
+		return nil, fmt.Errorf("failed to parse volume response: %v", err)
+	}
+	return &volResp, nil
 }
@@ -0,0 +1,1469 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"golang.org/x/net/context"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// fakeCall is a request received by fakeAPIClient
+type fakeCall struct {
+	method string
+	path   string
+	body   []byte
+}
+
+// fakeAPIClient is an apiClient answering with a per-test handler, the handler
+// returns the HTTP status and a value sent as JSON, or raw bytes as is
+type fakeAPIClient struct {
+	mu     sync.Mutex
+	calls  []fakeCall
+	handle func(call fakeCall) (int, interface{})
+}
+
+func (f *fakeAPIClient) Do(ctx context.Context, method, path string, body []byte) ([]byte, int, error) {
+	call := fakeCall{method: method, path: path, body: body}
+	f.mu.Lock()
+	f.calls = append(f.calls, call)
+	f.mu.Unlock()
+
+	statusCode, v := f.handle(call)
+	var data []byte
+	switch v := v.(type) {
+	case nil:
+	case []byte:
+		data = v
+	default:
+		var err error
+		if data, err = json.Marshal(v); err != nil {
+			return nil, 0, err
+		}
+	}
+	// Like httpAPIClient, an error status is returned as an *apiError
+	if statusCode >= http.StatusBadRequest {
+		return nil, statusCode, newAPIError(statusCode, data)
+	}
+	return data, statusCode, nil
+}
+
+// count returns the number of calls with the given method whose path starts with prefix
+func (f *fakeAPIClient) count(method, prefix string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n := 0
+	for _, c := range f.calls {
+		if c.method == method && strings.HasPrefix(c.path, prefix) {
+			n++
+		}
+	}
+	return n
+}
+
+// lastBody decodes the body of the last call with the given method and path prefix into v
+func (f *fakeAPIClient) lastBody(t *testing.T, method, prefix string, v interface{}) {
+	t.Helper()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i := len(f.calls) - 1; i >= 0; i-- {
+		if c := f.calls[i]; c.method == method && strings.HasPrefix(c.path, prefix) {
+			if err := json.Unmarshal(c.body, v); err != nil {
+				t.Fatalf("failed to decode %s %s body: %v", method, c.path, err)
+			}
+			return
+		}
+	}
+	t.Fatalf("no %s %s call", method, prefix)
+}
+
+// setFlag overrides a flag value for the duration of the test
+func setFlag[T any](t *testing.T, p *T, v T) {
+	old := *p
+	*p = v
+	t.Cleanup(func() { *p = old })
+}
+
+func newTestControllerServer(t *testing.T, api apiClient) *ControllerServer {
+	d := &driver{
+		name:          driverName,
+		version:       version,
+		initiatorName: "iqn.2025-04.net.virer.virium:controller",
+		api:           api,
+		writes:        newWriteLimiter(0),
+		volumes:       openVolumeStore(t, filepath.Join(t.TempDir(), "volumes.json"), ""),
+	}
+	return NewControllerServer(d)
+}
+
+func testVolume(id string, capacity int64) *VolumeResponse {
+	return &VolumeResponse{
+		VolumeID:     id,
+		TargetPortal: "192.168.0.10",
+		Iqn:          "iqn.2025-04.net.virer.virium:" + id,
+		Lun:          "1",
+		Capacity:     capacity,
+	}
+}
+
+func mountCapabilities(mode csi.VolumeCapability_AccessMode_Mode) []*csi.VolumeCapability {
+	return []*csi.VolumeCapability{{
+		AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: mode},
+	}}
+}
+
+func createVolumeRequest(name string, capacity int64) *csi.CreateVolumeRequest {
+	return &csi.CreateVolumeRequest{
+		Name:               name,
+		CapacityRange:      &csi.CapacityRange{RequiredBytes: capacity},
+		VolumeCapabilities: mountCapabilities(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER),
+	}
+}
+
+// fakeVolumeBackend answers the volume endpoints from an in-memory set of volumes
+type fakeVolumeBackend struct {
+	mu      sync.Mutex
+	nextID  int
+	volumes map[string]*VolumeResponse
+	names   map[string]string
+}
+
+func newFakeVolumeBackend() *fakeVolumeBackend {
+	return &fakeVolumeBackend{volumes: map[string]*VolumeResponse{}, names: map[string]string{}}
+}
+
+func (b *fakeVolumeBackend) handle(call fakeCall) (int, interface{}) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch {
+	case call.method == "POST" && call.path == "/api/volumes/create":
+		var req VolumeRequest
+		_ = json.Unmarshal(call.body, &req)
+		b.nextID++
+		vol := testVolume(fmt.Sprintf("vol-%d", b.nextID), req.Capacity)
+		vol.SnapshotID = req.SnapshotID
+		vol.SourceVolumeID = req.SourceVolumeID
+		b.volumes[vol.VolumeID] = vol
+		b.names[req.Name] = vol.VolumeID
+		return http.StatusCreated, vol
+	case call.method == "GET" && strings.HasPrefix(call.path, "/api/volumes/by-name/"):
+		if id, ok := b.names[strings.TrimPrefix(call.path, "/api/volumes/by-name/")]; ok {
+			return http.StatusOK, b.volumes[id]
+		}
+	case call.method == "GET" && strings.HasPrefix(call.path, "/api/volumes/"):
+		if vol, ok := b.volumes[strings.TrimPrefix(call.path, "/api/volumes/")]; ok {
+			return http.StatusOK, vol
+		}
+	}
+	return http.StatusNotFound, map[string]string{"error": "not found", "code": "not_found"}
+}
+
+func TestCreateVolumeIdempotent(t *testing.T) {
+	backend := newFakeVolumeBackend()
+	api := &fakeAPIClient{handle: backend.handle}
+	cs := newTestControllerServer(t, api)
+
+	first, err := cs.CreateVolume(context.Background(), createVolumeRequest("pvc-1", 1<<30))
+	if err != nil {
+		t.Fatalf("CreateVolume failed: %v", err)
+	}
+	second, err := cs.CreateVolume(context.Background(), createVolumeRequest("pvc-1", 1<<30))
+	if err != nil {
+		t.Fatalf("retried CreateVolume failed: %v", err)
+	}
+	if first.GetVolume().GetVolumeId() != second.GetVolume().GetVolumeId() {
+		t.Errorf("retried CreateVolume returned volume %s, want %s", second.GetVolume().GetVolumeId(), first.GetVolume().GetVolumeId())
+	}
+	if n := api.count("POST", "/api/volumes/create"); n != 1 {
+		t.Errorf("backend create called %d times, want 1", n)
+	}
+}
+
+func TestCreateVolumeExistingByName(t *testing.T) {
+	backend := newFakeVolumeBackend()
+	backend.volumes["vol-9"] = testVolume("vol-9", 2<<30)
+	backend.names["pvc-1"] = "vol-9"
+	api := &fakeAPIClient{handle: backend.handle}
+	cs := newTestControllerServer(t, api)
+
+	resp, err := cs.CreateVolume(context.Background(), createVolumeRequest("pvc-1", 1<<30))
+	if err != nil {
+		t.Fatalf("CreateVolume failed: %v", err)
+	}
+	if resp.GetVolume().GetVolumeId() != "vol-9" {
+		t.Errorf("CreateVolume returned volume %s, want vol-9", resp.GetVolume().GetVolumeId())
+	}
+	if n := api.count("POST", "/api/volumes/create"); n != 0 {
+		t.Errorf("backend create called %d times for an existing volume", n)
+	}
+
+	// A larger request can't be served by the existing volume
+	_, err = cs.CreateVolume(context.Background(), createVolumeRequest("pvc-1", 4<<30))
+	if status.Code(err) != codes.AlreadyExists {
+		t.Errorf("CreateVolume with an incompatible capacity returned %v, want AlreadyExists", err)
+	}
+}
+
+func TestCreateVolumeExistingWithoutCapacity(t *testing.T) {
+	backend := newFakeVolumeBackend()
+	backend.volumes["vol-9"] = testVolume("vol-9", 0)
+	backend.names["pvc-1"] = "vol-9"
+	api := &fakeAPIClient{handle: backend.handle}
+	cs := newTestControllerServer(t, api)
+
+	resp, err := cs.CreateVolume(context.Background(), createVolumeRequest("pvc-1", 1<<30))
+	if err != nil {
+		t.Fatalf("CreateVolume of a volume with no reported size failed: %v", err)
+	}
+	if resp.GetVolume().GetCapacityBytes() != 1<<30 {
+		t.Errorf("CreateVolume returned %d bytes, want the requested %d", resp.GetVolume().GetCapacityBytes(), 1<<30)
+	}
+}
+
+func TestCreateVolumeExistingContentSource(t *testing.T) {
+	fromSnapshot := func(id string) *csi.VolumeContentSource {
+		return &csi.VolumeContentSource{Type: &csi.VolumeContentSource_Snapshot{Snapshot: &csi.VolumeContentSource_SnapshotSource{SnapshotId: id}}}
+	}
+	fromVolume := func(id string) *csi.VolumeContentSource {
+		return &csi.VolumeContentSource{Type: &csi.VolumeContentSource_Volume{Volume: &csi.VolumeContentSource_VolumeSource{VolumeId: id}}}
+	}
+	tests := []struct {
+		name     string
+		snapshot string
+		source   string
+		src      *csi.VolumeContentSource
+		wantCode codes.Code
+	}{
+		{name: "same snapshot", snapshot: "snap-1", src: fromSnapshot("snap-1")},
+		{name: "same volume", source: "vol-0", src: fromVolume("vol-0")},
+		{name: "other snapshot", snapshot: "snap-1", src: fromSnapshot("snap-2"), wantCode: codes.AlreadyExists},
+		{name: "snapshot instead of clone", source: "vol-0", src: fromSnapshot("snap-1"), wantCode: codes.AlreadyExists},
+		{name: "source on a blank volume", src: fromSnapshot("snap-1"), wantCode: codes.AlreadyExists},
+		{name: "no source on a restored volume", snapshot: "snap-1", wantCode: codes.AlreadyExists},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backend := newFakeVolumeBackend()
+			vol := testVolume("vol-9", 1<<30)
+			vol.SnapshotID = tt.snapshot
+			vol.SourceVolumeID = tt.source
+			backend.volumes["vol-9"] = vol
+			backend.names["pvc-1"] = "vol-9"
+			cs := newTestControllerServer(t, &fakeAPIClient{handle: backend.handle})
+
+			req := createVolumeRequest("pvc-1", 1<<30)
+			req.VolumeContentSource = tt.src
+			_, err := cs.CreateVolume(context.Background(), req)
+			if status.Code(err) != tt.wantCode {
+				t.Errorf("CreateVolume returned %v, want %v", err, tt.wantCode)
+			}
+		})
+	}
+}
+
+func TestCreateVolumeBackendErrors(t *testing.T) {
+	tests := []struct {
+		name       string
+		statusCode int
+		body       interface{}
+		want       codes.Code
+	}{
+		{
+			name:       "conflict",
+			statusCode: http.StatusConflict,
+			body:       map[string]string{"error": "name taken", "code": "already_exists"},
+			want:       codes.AlreadyExists,
+		},
+		{
+			name:       "quota",
+			statusCode: http.StatusInsufficientStorage,
+			body:       map[string]string{"error": "pool full", "code": "quota_exceeded"},
+			want:       codes.ResourceExhausted,
+		},
+		{
+			name:       "server error",
+			statusCode: http.StatusInternalServerError,
+			body:       []byte("boom"),
+			want:       codes.Internal,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			api := &fakeAPIClient{handle: func(call fakeCall) (int, interface{}) {
+				if call.method == "POST" {
+					return tt.statusCode, tt.body
+				}
+				return http.StatusNotFound, nil
+			}}
+			cs := newTestControllerServer(t, api)
+
+			_, err := cs.CreateVolume(context.Background(), createVolumeRequest("pvc-1", 1<<30))
+			if status.Code(err) != tt.want {
+				t.Errorf("CreateVolume returned %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestCreateVolumeSourceNotFound(t *testing.T) {
+	api := &fakeAPIClient{handle: func(call fakeCall) (int, interface{}) {
+		return http.StatusNotFound, map[string]string{"error": "not found", "code": "not_found"}
+	}}
+	cs := newTestControllerServer(t, api)
+
+	req := createVolumeRequest("pvc-1", 1<<30)
+	req.VolumeContentSource = &csi.VolumeContentSource{
+		Type: &csi.VolumeContentSource_Snapshot{Snapshot: &csi.VolumeContentSource_SnapshotSource{SnapshotId: "snap-1"}},
+	}
+	_, err := cs.CreateVolume(context.Background(), req)
+	if status.Code(err) != codes.NotFound {
+		t.Errorf("CreateVolume from a missing snapshot returned %v, want NotFound", err)
+	}
+	if n := api.count("POST", "/api/volumes/"); n != 0 {
+		t.Errorf("backend create called %d times for a missing snapshot", n)
+	}
+}
+
+func TestCreateVolumeJobPolling(t *testing.T) {
+	setFlag(t, apiRetryDelay, time.Millisecond)
+
+	polls := 0
+	api := &fakeAPIClient{handle: func(call fakeCall) (int, interface{}) {
+		switch {
+		case call.method == "POST" && call.path == "/api/volumes/create":
+			return http.StatusAccepted, JobResponse{JobID: "job-1", Status: "running"}
+		case call.method == "GET" && call.path == "/api/jobs/job-1":
+			if polls++; polls < 3 {
+				return http.StatusOK, JobResponse{JobID: "job-1", Status: "running"}
+			}
+			result, _ := json.Marshal(testVolume("vol-1", 1<<30))
+			return http.StatusOK, JobResponse{JobID: "job-1", Status: "succeeded", Result: result}
+		}
+		return http.StatusNotFound, nil
+	}}
+	cs := newTestControllerServer(t, api)
+
+	resp, err := cs.CreateVolume(context.Background(), createVolumeRequest("pvc-1", 1<<30))
+	if err != nil {
+		t.Fatalf("CreateVolume failed: %v", err)
+	}
+	if resp.GetVolume().GetVolumeId() != "vol-1" {
+		t.Errorf("CreateVolume returned volume %s, want vol-1 from the job result", resp.GetVolume().GetVolumeId())
+	}
+	if polls != 3 {
+		t.Errorf("job polled %d times, want 3", polls)
+	}
+}
+
+func TestCreateVolumeJobTimeout(t *testing.T) {
+	setFlag(t, apiRetryDelay, time.Millisecond)
+
+	api := &fakeAPIClient{handle: func(call fakeCall) (int, interface{}) {
+		switch {
+		case call.method == "POST":
+			return http.StatusAccepted, JobResponse{JobID: "job-1", Status: "running"}
+		case call.path == "/api/jobs/job-1":
+			return http.StatusOK, JobResponse{JobID: "job-1", Status: "running"}
+		}
+		return http.StatusNotFound, nil
+	}}
+	cs := newTestControllerServer(t, api)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err := cs.CreateVolume(ctx, createVolumeRequest("pvc-1", 1<<30))
+	if status.Code(err) != codes.DeadlineExceeded {
+		t.Errorf("CreateVolume with a job still running returned %v, want DeadlineExceeded", err)
+	}
+}
+
+func TestCreateVolumeJobFailed(t *testing.T) {
+	setFlag(t, apiRetryDelay, time.Millisecond)
+
+	api := &fakeAPIClient{handle: func(call fakeCall) (int, interface{}) {
+		switch {
+		case call.method == "POST":
+			return http.StatusAccepted, JobResponse{JobID: "job-1", Status: "running"}
+		case call.path == "/api/jobs/job-1":
+			return http.StatusOK, JobResponse{JobID: "job-1", Status: "failed", Error: "pool full", Code: "quota_exceeded"}
+		}
+		return http.StatusNotFound, nil
+	}}
+	cs := newTestControllerServer(t, api)
+
+	_, err := cs.CreateVolume(context.Background(), createVolumeRequest("pvc-1", 1<<30))
+	if status.Code(err) != codes.ResourceExhausted {
+		t.Errorf("CreateVolume with a failed job returned %v, want ResourceExhausted", err)
+	}
+}
+
+func TestCreateVolumeCapacityRange(t *testing.T) {
+	tests := []struct {
+		name     string
+		capRange *csi.CapacityRange
+		want     int64
+		wantCode codes.Code
+	}{
+		{name: "nil range", capRange: nil, wantCode: codes.InvalidArgument},
+		{name: "limit only", capRange: &csi.CapacityRange{LimitBytes: 2 << 30}, want: 2 << 30},
+		{name: "required above limit", capRange: &csi.CapacityRange{RequiredBytes: 2 << 30, LimitBytes: 1 << 30}, wantCode: codes.InvalidArgument},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			api := &fakeAPIClient{handle: newFakeVolumeBackend().handle}
+			cs := newTestControllerServer(t, api)
+
+			req := createVolumeRequest("pvc-1", 0)
+			req.CapacityRange = tt.capRange
+			resp, err := cs.CreateVolume(context.Background(), req)
+			if status.Code(err) != tt.wantCode {
+				t.Fatalf("CreateVolume returned %v, want %v", err, tt.wantCode)
+			}
+			if err != nil {
+				if n := api.count("POST", "/api/volumes/"); n != 0 {
+					t.Errorf("backend create called %d times for an invalid range", n)
+				}
+				return
+			}
+			var payload VolumeRequest
+			api.lastBody(t, "POST", "/api/volumes/create", &payload)
+			if payload.Capacity != tt.want {
+				t.Errorf("backend asked for %d bytes, want %d", payload.Capacity, tt.want)
+			}
+			if resp.GetVolume().GetCapacityBytes() != tt.want {
+				t.Errorf("CreateVolume returned %d bytes, want %d", resp.GetVolume().GetCapacityBytes(), tt.want)
+			}
+		})
+	}
+}
+
+func TestCreateVolumePool(t *testing.T) {
+	tests := []struct {
+		name   string
+		params map[string]string
+		want   interface{}
+	}{
+		{name: "pool parameter", params: map[string]string{"pool": "ssd"}, want: "ssd"},
+		{name: "no pool", params: nil, want: nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			api := &fakeAPIClient{handle: newFakeVolumeBackend().handle}
+			cs := newTestControllerServer(t, api)
+
+			req := createVolumeRequest("pvc-1", 1<<30)
+			req.Parameters = tt.params
+			resp, err := cs.CreateVolume(context.Background(), req)
+			if err != nil {
+				t.Fatalf("CreateVolume failed: %v", err)
+			}
+			// decoded as a map so that the JSON field name is checked too
+			var payload map[string]interface{}
+			api.lastBody(t, "POST", "/api/volumes/create", &payload)
+			if payload["pool"] != tt.want {
+				t.Errorf("create payload pool = %v, want %v", payload["pool"], tt.want)
+			}
+			if tt.want != nil && resp.GetVolume().GetVolumeContext()[volCtxPool] != tt.want {
+				t.Errorf("volume context pool = %q, want %v", resp.GetVolume().GetVolumeContext()[volCtxPool], tt.want)
+			}
+		})
+	}
+}
+
+func TestCreateVolumeBackendName(t *testing.T) {
+	long := "pvc-" + strings.Repeat("0123456789", 8)
+	tests := []struct {
+		name   string
+		prefix string
+		want   string
+	}{
+		{name: "pvc-1", want: "pvc-1"},
+		{name: "pvc-1", prefix: "cluster1-", want: "cluster1-pvc-1"},
+		{name: "ns/pvc:1 é", want: "ns-pvc-1--"},
+		{name: long, prefix: "cluster1-", want: "cluster1-pvc-012345678901234567890123456789012345678901-98b50a58"},
+		{name: long + "x", prefix: "cluster1-", want: "cluster1-pvc-012345678901234567890123456789012345678901-466cc7d4"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.want, func(t *testing.T) {
+			setFlag(t, volumeNamePrefix, tt.prefix)
+			api := &fakeAPIClient{handle: newFakeVolumeBackend().handle}
+			cs := newTestControllerServer(t, api)
+
+			resp, err := cs.CreateVolume(context.Background(), createVolumeRequest(tt.name, 1<<30))
+			if err != nil {
+				t.Fatalf("CreateVolume failed: %v", err)
+			}
+			var payload VolumeRequest
+			api.lastBody(t, "POST", "/api/volumes/create", &payload)
+			if payload.Name != tt.want {
+				t.Errorf("create payload name = %q, want %q", payload.Name, tt.want)
+			}
+			if len(payload.Name) > maxBackendNameLength {
+				t.Errorf("create payload name is %d characters long, the backend accepts %d", len(payload.Name), maxBackendNameLength)
+			}
+			if id, ok := cs.Driver.volumes.volumeID(tt.want); !ok || id != resp.GetVolume().GetVolumeId() {
+				t.Errorf("volume store has %q, %v for %s, want %s", id, ok, tt.want, resp.GetVolume().GetVolumeId())
+			}
+		})
+	}
+}
+
+func TestCreateSnapshotPayload(t *testing.T) {
+	api := &fakeAPIClient{handle: func(call fakeCall) (int, interface{}) {
+		if call.method == "POST" && call.path == "/api/snapshot/create" {
+			return http.StatusCreated, SnapshotResponse{VolumeID: "snap-1", Capacity: 1 << 30}
+		}
+		return http.StatusNotFound, map[string]string{"error": "not found", "code": "not_found"}
+	}}
+	cs := newTestControllerServer(t, api)
+
+	resp, err := cs.CreateSnapshot(context.Background(), &csi.CreateSnapshotRequest{Name: "snapshot-1", SourceVolumeId: "vol-1"})
+	if err != nil {
+		t.Fatalf("CreateSnapshot failed: %v", err)
+	}
+	var payload map[string]string
+	api.lastBody(t, "POST", "/api/snapshot/create", &payload)
+	if payload["source_volume_id"] != "vol-1" || payload["name"] != "snapshot-1" {
+		t.Errorf("backend got %v, want source_volume_id vol-1 and name snapshot-1", payload)
+	}
+	if resp.GetSnapshot().GetSnapshotId() != "snap-1" || resp.GetSnapshot().GetSourceVolumeId() != "vol-1" {
+		t.Errorf("CreateSnapshot returned %v, want snapshot snap-1 of vol-1", resp.GetSnapshot())
+	}
+
+	for _, req := range []*csi.CreateSnapshotRequest{{SourceVolumeId: "vol-1"}, {Name: "snapshot-1"}} {
+		if _, err := cs.CreateSnapshot(context.Background(), req); status.Code(err) != codes.InvalidArgument {
+			t.Errorf("CreateSnapshot(%v) returned %v, want InvalidArgument", req, err)
+		}
+	}
+}
+
+// resizeBackend serves a volume of current bytes and grants resizes with granted bytes
+func resizeBackend(current, granted int64) func(call fakeCall) (int, interface{}) {
+	return func(call fakeCall) (int, interface{}) {
+		switch {
+		case call.method == "GET" && call.path == "/api/volumes/vol-1":
+			return http.StatusOK, testVolume("vol-1", current)
+		case call.method == "POST" && call.path == "/api/volumes/resize":
+			return http.StatusOK, testVolume("vol-1", granted)
+		}
+		return http.StatusNotFound, nil
+	}
+}
+
+func TestControllerExpandVolumeBackendSize(t *testing.T) {
+	block := &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}},
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+	}
+	tests := []struct {
+		name         string
+		granted      int64
+		capability   *csi.VolumeCapability
+		want         int64
+		wantNodeGrow bool
+		wantCode     codes.Code
+	}{
+		{name: "rounded up by the backend", granted: 3 << 30, capability: mountCapabilities(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER)[0], want: 3 << 30, wantNodeGrow: true},
+		{name: "raw block", granted: 2 << 30, capability: block, want: 2 << 30},
+		{name: "size not reported", granted: 0, want: 2 << 30, wantNodeGrow: true},
+		{name: "partially grown", granted: 1<<30 + 1, wantCode: codes.Internal},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cs := newTestControllerServer(t, &fakeAPIClient{handle: resizeBackend(1<<30, tt.granted)})
+
+			resp, err := cs.ControllerExpandVolume(context.Background(), &csi.ControllerExpandVolumeRequest{
+				VolumeId:         "vol-1",
+				CapacityRange:    &csi.CapacityRange{RequiredBytes: 2 << 30},
+				VolumeCapability: tt.capability,
+			})
+			if status.Code(err) != tt.wantCode {
+				t.Fatalf("ControllerExpandVolume returned %v, want %v", err, tt.wantCode)
+			}
+			if err != nil {
+				return
+			}
+			if resp.GetCapacityBytes() != tt.want {
+				t.Errorf("ControllerExpandVolume returned %d bytes, want %d", resp.GetCapacityBytes(), tt.want)
+			}
+			if resp.GetNodeExpansionRequired() != tt.wantNodeGrow {
+				t.Errorf("NodeExpansionRequired = %v, want %v", resp.GetNodeExpansionRequired(), tt.wantNodeGrow)
+			}
+		})
+	}
+}
+
+func TestGetCapacity(t *testing.T) {
+	maxSize := int64(8 << 30)
+	tests := []struct {
+		name       string
+		statusCode int
+		body       interface{}
+		want       int64
+		wantCode   codes.Code
+	}{
+		{name: "available", statusCode: http.StatusOK, body: CapacityResponse{AvailableCapacity: 4 << 30, MaximumVolumeSize: &maxSize}, want: 4 << 30},
+		{name: "unknown pool", statusCode: http.StatusNotFound, body: map[string]string{"error": "no pool fast", "code": "not_found"}, want: 0},
+		{name: "no capacity endpoint", statusCode: http.StatusNotFound, body: []byte("404 page not found"), wantCode: codes.Unimplemented},
+		{name: "server error", statusCode: http.StatusInternalServerError, body: map[string]string{"error": "boom", "code": "internal"}, wantCode: codes.Internal},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			api := &fakeAPIClient{handle: func(call fakeCall) (int, interface{}) {
+				return tt.statusCode, tt.body
+			}}
+			cs := newTestControllerServer(t, api)
+
+			resp, err := cs.GetCapacity(context.Background(), &csi.GetCapacityRequest{
+				Parameters: map[string]string{
+					paramPool: "fast",
+					"fsType":  "xfs",
+					"csi.storage.k8s.io/provisioner-secret-name": "virium",
+				},
+			})
+			if status.Code(err) != tt.wantCode {
+				t.Fatalf("GetCapacity returned %v, want %v", err, tt.wantCode)
+			}
+			if resp.GetAvailableCapacity() != tt.want {
+				t.Errorf("GetCapacity returned %d bytes, want %d", resp.GetAvailableCapacity(), tt.want)
+			}
+			if path := api.calls[0].path; path != "/api/capacity?pool=fast" {
+				t.Errorf("capacity queried with %s, want only the pool forwarded", path)
+			}
+		})
+	}
+}
+
+func TestValidateVolumeCapabilities(t *testing.T) {
+	backend := newFakeVolumeBackend()
+	backend.volumes["vol-1"] = testVolume("vol-1", 1<<30)
+	cs := newTestControllerServer(t, &fakeAPIClient{handle: backend.handle})
+
+	tests := []struct {
+		name          string
+		volumeID      string
+		mode          csi.VolumeCapability_AccessMode_Mode
+		wantCode      codes.Code
+		wantConfirmed bool
+	}{
+		{name: "supported mode", volumeID: "vol-1", mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER, wantConfirmed: true},
+		{name: "multi node writer filesystem", volumeID: "vol-1", mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER},
+		{name: "unknown volume", volumeID: "vol-404", mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER, wantCode: codes.NotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := cs.ValidateVolumeCapabilities(context.Background(), &csi.ValidateVolumeCapabilitiesRequest{
+				VolumeId:           tt.volumeID,
+				VolumeCapabilities: mountCapabilities(tt.mode),
+			})
+			if status.Code(err) != tt.wantCode {
+				t.Fatalf("ValidateVolumeCapabilities returned %v, want %v", err, tt.wantCode)
+			}
+			if confirmed := resp.GetConfirmed() != nil; confirmed != tt.wantConfirmed {
+				t.Errorf("confirmed = %v, want %v (message %q)", confirmed, tt.wantConfirmed, resp.GetMessage())
+			}
+		})
+	}
+}
+
+func TestCreateVolumeAccessModes(t *testing.T) {
+	for value, name := range csi.VolumeCapability_AccessMode_Mode_name {
+		mode := csi.VolumeCapability_AccessMode_Mode(value)
+		t.Run(name, func(t *testing.T) {
+			cs := newTestControllerServer(t, &fakeAPIClient{handle: newFakeVolumeBackend().handle})
+
+			req := createVolumeRequest("pvc-1", 1<<30)
+			req.VolumeCapabilities = mountCapabilities(mode)
+			_, err := cs.CreateVolume(context.Background(), req)
+			wantCode := codes.OK
+			switch mode {
+			case csi.VolumeCapability_AccessMode_UNKNOWN,
+				csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER,
+				csi.VolumeCapability_AccessMode_MULTI_NODE_SINGLE_WRITER:
+				wantCode = codes.InvalidArgument
+			}
+			if status.Code(err) != wantCode {
+				t.Errorf("CreateVolume of a %s filesystem returned %v, want %v", name, err, wantCode)
+			}
+		})
+	}
+}
+
+func publishRequest(volumeID, nodeID string, mode csi.VolumeCapability_AccessMode_Mode) *csi.ControllerPublishVolumeRequest {
+	return &csi.ControllerPublishVolumeRequest{
+		VolumeId:         volumeID,
+		NodeId:           nodeID,
+		VolumeCapability: mountCapabilities(mode)[0],
+	}
+}
+
+func TestControllerPublishVolumeInitiator(t *testing.T) {
+	tests := []struct {
+		name     string
+		nodeID   string
+		format   string
+		want     string
+		wantCode codes.Code
+	}{
+		{name: "node ID is an IQN", nodeID: "iqn.2005-03.org.open-iscsi:worker-1", want: "iqn.2005-03.org.open-iscsi:worker-1"},
+		{name: "formatted from the node ID", nodeID: "worker-1", format: "iqn.2025-04.net.virer.virium:%s", want: "iqn.2025-04.net.virer.virium:worker-1"},
+		{name: "driver initiator without a format", nodeID: "worker-1", want: "iqn.2025-04.net.virer.virium:controller"},
+		{name: "format yielding an invalid IQN", nodeID: "worker 1", format: "iqn.2025-04.net.virer.virium:%s", wantCode: codes.FailedPrecondition},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setFlag(t, nodeInitiatorFormat, tt.format)
+			api := &fakeAPIClient{handle: func(call fakeCall) (int, interface{}) {
+				return http.StatusOK, AttachResponse{}
+			}}
+			cs := newTestControllerServer(t, api)
+
+			_, err := cs.ControllerPublishVolume(context.Background(), publishRequest("vol-1", tt.nodeID, csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER))
+			if status.Code(err) != tt.wantCode {
+				t.Fatalf("ControllerPublishVolume returned %v, want %v", err, tt.wantCode)
+			}
+			if err != nil {
+				return
+			}
+			var payload AttachRequest
+			api.lastBody(t, "POST", "/api/volumes/vol-1/attach", &payload)
+			if payload.InitiatorName != tt.want {
+				t.Errorf("ACL initiator = %q, want %q", payload.InitiatorName, tt.want)
+			}
+		})
+	}
+}
+
+// attachBackend refuses an attach with 409 Conflict once vol-1 is attached to node,
+// the attachment carries its publish context
+func attachBackend(node string, publishContext map[string]string) func(call fakeCall) (int, interface{}) {
+	return func(call fakeCall) (int, interface{}) {
+		switch {
+		case call.method == "POST" && call.path == "/api/volumes/vol-1/attach":
+			return http.StatusConflict, map[string]string{"error": "volume vol-1 is attached", "code": "conflict"}
+		case call.method == "GET" && call.path == "/api/volumes/vol-1":
+			vol := testVolume("vol-1", 1<<30)
+			vol.PublishedNodeIDs = []string{node}
+			vol.Attachments = []VolumeAttachment{{NodeID: node, PublishContext: publishContext}}
+			return http.StatusOK, vol
+		}
+		return http.StatusNotFound, nil
+	}
+}
+
+func TestControllerPublishVolumeConflict(t *testing.T) {
+	node1 := "iqn.2005-03.org.open-iscsi:worker-1"
+	node2 := "iqn.2005-03.org.open-iscsi:worker-2"
+	publishContext := map[string]string{"lunPath": "/dev/disk/by-path/lun-1"}
+	tests := []struct {
+		name     string
+		nodeID   string
+		mode     csi.VolumeCapability_AccessMode_Mode
+		wantCode codes.Code
+	}{
+		{name: "retry on the same node", nodeID: node1, mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+		{name: "single node volume on another node", nodeID: node2, mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER, wantCode: codes.FailedPrecondition},
+		{name: "read only single node volume on another node", nodeID: node2, mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY, wantCode: codes.FailedPrecondition},
+		{name: "multi node volume refused", nodeID: node2, mode: csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY, wantCode: codes.Aborted},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cs := newTestControllerServer(t, &fakeAPIClient{handle: attachBackend(node1, publishContext)})
+
+			resp, err := cs.ControllerPublishVolume(context.Background(), publishRequest("vol-1", tt.nodeID, tt.mode))
+			if status.Code(err) != tt.wantCode {
+				t.Fatalf("ControllerPublishVolume returned %v, want %v", err, tt.wantCode)
+			}
+			if err == nil && resp.GetPublishContext()["lunPath"] != publishContext["lunPath"] {
+				t.Errorf("retried publish returned context %v, want %v", resp.GetPublishContext(), publishContext)
+			}
+		})
+	}
+}
+
+func TestControllerPublishVolumeMockBackend(t *testing.T) {
+	mock := newMockAPIClient()
+	cs := newTestControllerServer(t, mock)
+	vol, err := cs.CreateVolume(context.Background(), createVolumeRequest("pvc-1", 1<<30))
+	if err != nil {
+		t.Fatalf("CreateVolume failed: %v", err)
+	}
+	volumeID := vol.GetVolume().GetVolumeId()
+	node1 := "iqn.2005-03.org.open-iscsi:worker-1"
+	node2 := "iqn.2005-03.org.open-iscsi:worker-2"
+
+	for i := 0; i < 2; i++ {
+		if _, err := cs.ControllerPublishVolume(context.Background(), publishRequest(volumeID, node1, csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER)); err != nil {
+			t.Fatalf("publish %d on %s failed: %v", i+1, node1, err)
+		}
+	}
+	_, err = cs.ControllerPublishVolume(context.Background(), publishRequest(volumeID, node2, csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER))
+	if status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("publish of an attached single node volume on %s returned %v, want FailedPrecondition", node2, err)
+	}
+
+	if _, err := cs.ControllerUnpublishVolume(context.Background(), &csi.ControllerUnpublishVolumeRequest{VolumeId: volumeID, NodeId: node1}); err != nil {
+		t.Fatalf("unpublish failed: %v", err)
+	}
+	if _, err := cs.ControllerPublishVolume(context.Background(), publishRequest(volumeID, node2, csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER)); err != nil {
+		t.Errorf("publish on %s after unpublish failed: %v", node2, err)
+	}
+}
+
+func TestDeleteVolumeNotFound(t *testing.T) {
+	tests := []struct {
+		name       string
+		statusCode int
+		body       interface{}
+		wantCode   codes.Code
+	}{
+		{name: "deleted", statusCode: http.StatusOK},
+		{name: "not_found envelope", statusCode: http.StatusNotFound, body: map[string]string{"error": "no volume vol-1", "code": "not_found"}},
+		{name: "bare 404", statusCode: http.StatusNotFound, body: []byte("404 page not found")},
+		{name: "backend failure", statusCode: http.StatusInternalServerError, body: map[string]string{"error": "lvremove failed"}, wantCode: codes.Internal},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			api := &fakeAPIClient{handle: func(call fakeCall) (int, interface{}) {
+				if call.method == "DELETE" && call.path == "/api/volumes/delete" {
+					return tt.statusCode, tt.body
+				}
+				return http.StatusNotFound, map[string]string{"error": "not found", "code": "not_found"}
+			}}
+			cs := newTestControllerServer(t, api)
+			cs.Driver.volumes.putVolume(context.Background(), "pvc-1", "vol-1")
+
+			_, err := cs.DeleteVolume(context.Background(), &csi.DeleteVolumeRequest{VolumeId: "vol-1"})
+			if status.Code(err) != tt.wantCode {
+				t.Fatalf("DeleteVolume returned %v, want %v", err, tt.wantCode)
+			}
+			if n := api.count("DELETE", "/api/volumes/delete"); n != 1 {
+				t.Errorf("DeleteVolume sent %d delete calls, want 1", n)
+			}
+			_, recorded := cs.Driver.volumes.volumeID("pvc-1")
+			if recorded != (err != nil) {
+				t.Errorf("volume store entry kept = %v after DeleteVolume returned %v", recorded, err)
+			}
+		})
+	}
+}
+
+func TestDeleteVolumePublished(t *testing.T) {
+	tests := []struct {
+		name        string
+		nodes       []string
+		forceDelete bool
+		wantCode    codes.Code
+	}{
+		{name: "unpublished"},
+		{name: "published", nodes: []string{"worker-1"}, wantCode: codes.FailedPrecondition},
+		{name: "published with -force_delete", nodes: []string{"worker-1", "worker-2"}, forceDelete: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setFlag(t, forceDelete, tt.forceDelete)
+			api := &fakeAPIClient{handle: func(call fakeCall) (int, interface{}) {
+				switch {
+				case call.method == "GET" && call.path == "/api/volumes/vol-1":
+					vol := testVolume("vol-1", 1<<30)
+					vol.PublishedNodeIDs = tt.nodes
+					return http.StatusOK, vol
+				case call.method == "DELETE" && call.path == "/api/volumes/delete":
+					return http.StatusOK, nil
+				}
+				return http.StatusNotFound, map[string]string{"error": "not found", "code": "not_found"}
+			}}
+			cs := newTestControllerServer(t, api)
+			cs.Driver.volumes.putVolume(context.Background(), "pvc-1", "vol-1")
+
+			_, err := cs.DeleteVolume(context.Background(), &csi.DeleteVolumeRequest{VolumeId: "vol-1"})
+			if status.Code(err) != tt.wantCode {
+				t.Fatalf("DeleteVolume returned %v, want %v", err, tt.wantCode)
+			}
+			wantDeletes := 1
+			if err != nil {
+				wantDeletes = 0
+			}
+			if n := api.count("DELETE", "/api/volumes/delete"); n != wantDeletes {
+				t.Errorf("DeleteVolume sent %d delete calls, want %d", n, wantDeletes)
+			}
+			if _, recorded := cs.Driver.volumes.volumeID("pvc-1"); recorded != (err != nil) {
+				t.Errorf("volume store entry kept = %v after DeleteVolume returned %v", recorded, err)
+			}
+		})
+	}
+}
+
+func TestDeleteSnapshotNotFound(t *testing.T) {
+	tests := []struct {
+		name       string
+		statusCode int
+		body       interface{}
+		wantCode   codes.Code
+	}{
+		{name: "deleted", statusCode: http.StatusOK},
+		{name: "not_found envelope", statusCode: http.StatusNotFound, body: map[string]string{"error": "no snapshot snap-1", "code": "not_found"}},
+		{name: "bare 404", statusCode: http.StatusNotFound, body: []byte("404 page not found")},
+		{name: "backend failure", statusCode: http.StatusInternalServerError, body: map[string]string{"error": "lvremove failed"}, wantCode: codes.Internal},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			api := &fakeAPIClient{handle: func(call fakeCall) (int, interface{}) {
+				if call.method == "DELETE" && call.path == "/api/snapshot/delete" {
+					return tt.statusCode, tt.body
+				}
+				return http.StatusNotFound, nil
+			}}
+			cs := newTestControllerServer(t, api)
+			cs.Driver.volumes.putSnapshot(context.Background(), "snapshot-1", "snap-1", "vol-1")
+
+			_, err := cs.DeleteSnapshot(context.Background(), &csi.DeleteSnapshotRequest{SnapshotId: "snap-1"})
+			if status.Code(err) != tt.wantCode {
+				t.Fatalf("DeleteSnapshot returned %v, want %v", err, tt.wantCode)
+			}
+			if n := api.count("DELETE", "/api/snapshot/delete"); n != 1 {
+				t.Errorf("DeleteSnapshot sent %d delete calls, want 1", n)
+			}
+			_, recorded := cs.Driver.volumes.state.Snapshots["snapshot-1"]
+			if recorded != (err != nil) {
+				t.Errorf("volume store entry kept = %v after DeleteSnapshot returned %v", recorded, err)
+			}
+		})
+	}
+}
+
+func TestMaxVolumeSize(t *testing.T) {
+	setFlag(t, maxVolumeSize, int64(4<<30))
+	tests := []struct {
+		name     string
+		size     int64
+		wantCode codes.Code
+	}{
+		{name: "at the maximum", size: 4 << 30},
+		{name: "one byte over", size: 4<<30 + 1, wantCode: codes.OutOfRange},
+	}
+	for _, tt := range tests {
+		t.Run("create "+tt.name, func(t *testing.T) {
+			api := &fakeAPIClient{handle: newFakeVolumeBackend().handle}
+			cs := newTestControllerServer(t, api)
+
+			_, err := cs.CreateVolume(context.Background(), createVolumeRequest("pvc-1", tt.size))
+			if status.Code(err) != tt.wantCode {
+				t.Fatalf("CreateVolume returned %v, want %v", err, tt.wantCode)
+			}
+			if n := api.count("POST", "/api/volumes/create"); (n == 0) != (err != nil) {
+				t.Errorf("backend create called %d times, CreateVolume returned %v", n, err)
+			}
+		})
+		t.Run("expand "+tt.name, func(t *testing.T) {
+			api := &fakeAPIClient{handle: resizeBackend(1<<30, tt.size)}
+			cs := newTestControllerServer(t, api)
+
+			_, err := cs.ControllerExpandVolume(context.Background(), &csi.ControllerExpandVolumeRequest{
+				VolumeId:      "vol-1",
+				CapacityRange: &csi.CapacityRange{RequiredBytes: tt.size},
+			})
+			if status.Code(err) != tt.wantCode {
+				t.Fatalf("ControllerExpandVolume returned %v, want %v", err, tt.wantCode)
+			}
+			if n := api.count("POST", "/api/volumes/resize"); (n == 0) != (err != nil) {
+				t.Errorf("backend resize called %d times, ControllerExpandVolume returned %v", n, err)
+			}
+		})
+	}
+}
+
+func TestCreateVolumeErrorInfo(t *testing.T) {
+	tests := []struct {
+		name       string
+		statusCode int
+		body       interface{}
+		wantCode   codes.Code
+		wantInfo   *errdetails.ErrorInfo
+	}{
+		{
+			name:       "quota exceeded",
+			statusCode: http.StatusInsufficientStorage,
+			body:       map[string]interface{}{"error": "pool fast is full", "code": "quota_exceeded", "metadata": map[string]string{"pool": "fast"}},
+			wantCode:   codes.ResourceExhausted,
+			wantInfo:   &errdetails.ErrorInfo{Reason: "QUOTA_EXCEEDED", Domain: errorDomain, Metadata: map[string]string{"httpStatus": "507", "pool": "fast"}},
+		},
+		{
+			name:       "no envelope code",
+			statusCode: http.StatusInsufficientStorage,
+			body:       map[string]string{"error": "pool fast is full"},
+			wantCode:   codes.ResourceExhausted,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			api := &fakeAPIClient{handle: func(call fakeCall) (int, interface{}) {
+				if call.method == "POST" && call.path == "/api/volumes/create" {
+					return tt.statusCode, tt.body
+				}
+				return http.StatusNotFound, map[string]string{"error": "not found", "code": "not_found"}
+			}}
+			cs := newTestControllerServer(t, api)
+
+			_, err := cs.CreateVolume(context.Background(), createVolumeRequest("pvc-1", 1<<30))
+			st := status.Convert(err)
+			if st.Code() != tt.wantCode {
+				t.Fatalf("CreateVolume returned %v, want %v", err, tt.wantCode)
+			}
+			var info *errdetails.ErrorInfo
+			for _, d := range st.Details() {
+				if i, ok := d.(*errdetails.ErrorInfo); ok {
+					info = i
+				}
+			}
+			if tt.wantInfo == nil {
+				if info != nil {
+					t.Errorf("CreateVolume error carries ErrorInfo %v, want none", info)
+				}
+				return
+			}
+			if info == nil {
+				t.Fatalf("CreateVolume error %v carries no ErrorInfo", err)
+			}
+			if info.Reason != tt.wantInfo.Reason || info.Domain != tt.wantInfo.Domain {
+				t.Errorf("ErrorInfo reason/domain = %s/%s, want %s/%s", info.Reason, info.Domain, tt.wantInfo.Reason, tt.wantInfo.Domain)
+			}
+			for k, v := range tt.wantInfo.Metadata {
+				if info.Metadata[k] != v {
+					t.Errorf("ErrorInfo metadata %s = %q, want %q", k, info.Metadata[k], v)
+				}
+			}
+		})
+	}
+}
+
+func TestControllerExpandVolumeCurrentSize(t *testing.T) {
+	tests := []struct {
+		name       string
+		current    int64
+		required   int64
+		want       int64
+		wantResize bool
+		wantCode   codes.Code
+	}{
+		{name: "shrink", current: 2 << 30, required: 1 << 30, wantCode: codes.InvalidArgument},
+		{name: "same size", current: 2 << 30, required: 2 << 30, want: 2 << 30},
+		{name: "grow", current: 1 << 30, required: 2 << 30, want: 2 << 30, wantResize: true},
+		{name: "current size unknown", current: 0, required: 2 << 30, want: 2 << 30, wantResize: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			api := &fakeAPIClient{handle: resizeBackend(tt.current, tt.required)}
+			cs := newTestControllerServer(t, api)
+
+			resp, err := cs.ControllerExpandVolume(context.Background(), &csi.ControllerExpandVolumeRequest{
+				VolumeId:      "vol-1",
+				CapacityRange: &csi.CapacityRange{RequiredBytes: tt.required},
+			})
+			if status.Code(err) != tt.wantCode {
+				t.Fatalf("ControllerExpandVolume returned %v, want %v", err, tt.wantCode)
+			}
+			if n := api.count("POST", "/api/volumes/resize"); (n > 0) != tt.wantResize {
+				t.Errorf("backend resize called %d times, want called %v", n, tt.wantResize)
+			}
+			if err == nil && resp.GetCapacityBytes() != tt.want {
+				t.Errorf("ControllerExpandVolume returned %d bytes, want %d", resp.GetCapacityBytes(), tt.want)
+			}
+		})
+	}
+}
+
+func TestStaticVolumeID(t *testing.T) {
+	static := createVolumeRequest("pvc-static", 1<<30)
+	static.Parameters = map[string]string{
+		paramExistingTarget: "192.168.0.20:3260",
+		paramExistingIQN:    "iqn.2025-04.net.virer.virium:existing",
+		paramExistingLUN:    "0",
+	}
+	tests := []struct {
+		name        string
+		req         *csi.CreateVolumeRequest
+		backendID   string
+		wantID      string
+		wantCode    codes.Code
+		wantBackend bool
+	}{
+		{name: "pre-provisioned target", req: static, wantID: "static:pvc-static"},
+		{name: "backend ID with the old static- prefix", req: createVolumeRequest("pvc-1", 1<<30), backendID: "static-1", wantID: "static-1", wantBackend: true},
+		{name: "backend ID with the static prefix", req: createVolumeRequest("pvc-1", 1<<30), backendID: "static:1", wantCode: codes.Internal},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			api := &fakeAPIClient{handle: func(call fakeCall) (int, interface{}) {
+				switch {
+				case call.method == "POST" && call.path == "/api/volumes/create":
+					return http.StatusCreated, testVolume(tt.backendID, 1<<30)
+				case call.method == "DELETE":
+					return http.StatusOK, nil
+				}
+				return http.StatusNotFound, map[string]string{"error": "not found", "code": "not_found"}
+			}}
+			cs := newTestControllerServer(t, api)
+
+			resp, err := cs.CreateVolume(context.Background(), tt.req)
+			if status.Code(err) != tt.wantCode {
+				t.Fatalf("CreateVolume returned %v, want %v", err, tt.wantCode)
+			}
+			if err != nil {
+				return
+			}
+			if id := resp.GetVolume().GetVolumeId(); id != tt.wantID {
+				t.Fatalf("CreateVolume returned ID %s, want %s", id, tt.wantID)
+			}
+
+			// Only a backend volume is deleted on the backend
+			if _, err := cs.DeleteVolume(context.Background(), &csi.DeleteVolumeRequest{VolumeId: tt.wantID}); err != nil {
+				t.Fatalf("DeleteVolume failed: %v", err)
+			}
+			if n := api.count("DELETE", "/api/volumes/delete"); (n > 0) != tt.wantBackend {
+				t.Errorf("backend delete called %d times, want called %v", n, tt.wantBackend)
+			}
+		})
+	}
+}
+
+// listAllVolumes pages through ListVolumes and returns the IDs in order
+func listAllVolumes(t *testing.T, cs *ControllerServer, maxEntries int32) []string {
+	t.Helper()
+	var ids []string
+	token := ""
+	for pages := 0; ; pages++ {
+		if pages > 100 {
+			t.Fatalf("ListVolumes did not reach the last page")
+		}
+		resp, err := cs.ListVolumes(context.Background(), &csi.ListVolumesRequest{MaxEntries: maxEntries, StartingToken: token})
+		if err != nil {
+			t.Fatalf("ListVolumes failed: %v", err)
+		}
+		if maxEntries > 0 && len(resp.GetEntries()) > int(maxEntries) {
+			t.Fatalf("ListVolumes returned %d entries, more than %d", len(resp.GetEntries()), maxEntries)
+		}
+		for _, e := range resp.GetEntries() {
+			ids = append(ids, e.GetVolume().GetVolumeId())
+		}
+		if token = resp.GetNextToken(); token == "" {
+			return ids
+		}
+	}
+}
+
+func TestListVolumesPages(t *testing.T) {
+	for _, count := range []int{0, 1, 4, 5} {
+		for _, maxEntries := range []int32{0, 1, 2, 5} {
+			t.Run(fmt.Sprintf("%d volumes by %d", count, maxEntries), func(t *testing.T) {
+				mock := newMockAPIClient()
+				cs := newTestControllerServer(t, mock)
+				var want []string
+				for i := 0; i < count; i++ {
+					resp, err := cs.CreateVolume(context.Background(), createVolumeRequest(fmt.Sprintf("pvc-%d", i), 1<<20))
+					if err != nil {
+						t.Fatalf("CreateVolume failed: %v", err)
+					}
+					want = append(want, resp.GetVolume().GetVolumeId())
+				}
+
+				got := listAllVolumes(t, cs, maxEntries)
+				if strings.Join(got, ",") != strings.Join(want, ",") {
+					t.Errorf("ListVolumes pages returned %v, want %v", got, want)
+				}
+			})
+		}
+	}
+}
+
+func TestListVolumesDeletedMidList(t *testing.T) {
+	mock := newMockAPIClient()
+	cs := newTestControllerServer(t, mock)
+	var ids []string
+	for i := 0; i < 6; i++ {
+		resp, err := cs.CreateVolume(context.Background(), createVolumeRequest(fmt.Sprintf("pvc-%d", i), 1<<20))
+		if err != nil {
+			t.Fatalf("CreateVolume failed: %v", err)
+		}
+		ids = append(ids, resp.GetVolume().GetVolumeId())
+	}
+	deleteVolume := func(id string) {
+		if _, err := cs.DeleteVolume(context.Background(), &csi.DeleteVolumeRequest{VolumeId: id}); err != nil {
+			t.Fatalf("DeleteVolume failed: %v", err)
+		}
+	}
+
+	first, err := cs.ListVolumes(context.Background(), &csi.ListVolumesRequest{MaxEntries: 2})
+	if err != nil {
+		t.Fatalf("ListVolumes failed: %v", err)
+	}
+
+	// A volume deleted after the token keeps the following pages consistent
+	deleteVolume(ids[3])
+	second, err := cs.ListVolumes(context.Background(), &csi.ListVolumesRequest{MaxEntries: 2, StartingToken: first.GetNextToken()})
+	if err != nil {
+		t.Fatalf("ListVolumes after deleting %s failed: %v", ids[3], err)
+	}
+	var got []string
+	for _, e := range second.GetEntries() {
+		got = append(got, e.GetVolume().GetVolumeId())
+	}
+	if want := []string{ids[2], ids[4]}; strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("second page returned %v, want %v", got, want)
+	}
+
+	// Deleting the volume a token resumes after invalidates the token
+	deleteVolume(ids[4])
+	_, err = cs.ListVolumes(context.Background(), &csi.ListVolumesRequest{MaxEntries: 2, StartingToken: second.GetNextToken()})
+	if status.Code(err) != codes.Aborted {
+		t.Errorf("ListVolumes resuming after deleted %s returned %v, want Aborted", ids[4], err)
+	}
+}
+
+func TestListSnapshotsPages(t *testing.T) {
+	mock := newMockAPIClient()
+	cs := newTestControllerServer(t, mock)
+	vol, err := cs.CreateVolume(context.Background(), createVolumeRequest("pvc-1", 1<<20))
+	if err != nil {
+		t.Fatalf("CreateVolume failed: %v", err)
+	}
+	var want []string
+	for i := 0; i < 5; i++ {
+		resp, err := cs.CreateSnapshot(context.Background(), &csi.CreateSnapshotRequest{Name: fmt.Sprintf("snapshot-%d", i), SourceVolumeId: vol.GetVolume().GetVolumeId()})
+		if err != nil {
+			t.Fatalf("CreateSnapshot failed: %v", err)
+		}
+		want = append(want, resp.GetSnapshot().GetSnapshotId())
+	}
+
+	var got []string
+	token := ""
+	for pages := 0; pages < 10; pages++ {
+		resp, err := cs.ListSnapshots(context.Background(), &csi.ListSnapshotsRequest{MaxEntries: 2, StartingToken: token})
+		if err != nil {
+			t.Fatalf("ListSnapshots failed: %v", err)
+		}
+		for _, e := range resp.GetEntries() {
+			got = append(got, e.GetSnapshot().GetSnapshotId())
+		}
+		if token = resp.GetNextToken(); token == "" {
+			break
+		}
+	}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("ListSnapshots pages returned %v, want %v", got, want)
+	}
+
+	// Deleting the snapshot a token resumes after invalidates the token
+	first, err := cs.ListSnapshots(context.Background(), &csi.ListSnapshotsRequest{MaxEntries: 2})
+	if err != nil {
+		t.Fatalf("ListSnapshots failed: %v", err)
+	}
+	if _, err := cs.DeleteSnapshot(context.Background(), &csi.DeleteSnapshotRequest{SnapshotId: want[1]}); err != nil {
+		t.Fatalf("DeleteSnapshot failed: %v", err)
+	}
+	_, err = cs.ListSnapshots(context.Background(), &csi.ListSnapshotsRequest{MaxEntries: 2, StartingToken: first.GetNextToken()})
+	if status.Code(err) != codes.Aborted {
+		t.Errorf("ListSnapshots resuming after deleted %s returned %v, want Aborted", want[1], err)
+	}
+}
+
+func TestListTokenInvalid(t *testing.T) {
+	cs := newTestControllerServer(t, newMockAPIClient())
+	tokens := map[string]string{
+		"not base64":       "%%%",
+		"not json":         base64.RawURLEncoding.EncodeToString([]byte("after=vol-1")),
+		"no anchor":        encodeListToken(listSortVolumes, ""),
+		"a snapshot token": encodeListToken(listSortSnapshots, "mock-snap-000001"),
+		"a numeric offset": "2",
+	}
+	for name, token := range tokens {
+		_, err := cs.ListVolumes(context.Background(), &csi.ListVolumesRequest{StartingToken: token})
+		if status.Code(err) != codes.Aborted {
+			t.Errorf("ListVolumes with %s returned %v, want Aborted", name, err)
+		}
+	}
+
+	if _, err := cs.ListVolumes(context.Background(), &csi.ListVolumesRequest{MaxEntries: -1}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("ListVolumes with negative max entries returned %v, want InvalidArgument", err)
+	}
+	if _, err := cs.ListSnapshots(context.Background(), &csi.ListSnapshotsRequest{MaxEntries: -1}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("ListSnapshots with negative max entries returned %v, want InvalidArgument", err)
+	}
+}
+
+func TestControllerModifyVolume(t *testing.T) {
+	tests := []struct {
+		name        string
+		volumeID    string
+		params      map[string]string
+		wantPayload string
+		wantCode    codes.Code
+	}{
+		{name: "qos policy", volumeID: "vol-1", params: map[string]string{"qosPolicy": "gold"}, wantPayload: `{"qos_policy":"gold"}`},
+		{name: "limits", volumeID: "vol-1", params: map[string]string{"iopsLimit": "5000", "bandwidthLimit": "104857600"}, wantPayload: `{"iops_limit":5000,"bandwidth_limit":104857600}`},
+		{name: "limit removed", volumeID: "vol-1", params: map[string]string{"iopsLimit": "0"}, wantPayload: `{"iops_limit":0}`},
+		{name: "no parameters", volumeID: "vol-1"},
+		{name: "unknown parameter", volumeID: "vol-1", params: map[string]string{"pool": "fast"}, wantCode: codes.InvalidArgument},
+		{name: "negative limit", volumeID: "vol-1", params: map[string]string{"iopsLimit": "-1"}, wantCode: codes.InvalidArgument},
+		{name: "limit not a number", volumeID: "vol-1", params: map[string]string{"bandwidthLimit": "100M"}, wantCode: codes.InvalidArgument},
+		{name: "empty qos policy", volumeID: "vol-1", params: map[string]string{"qosPolicy": ""}, wantCode: codes.InvalidArgument},
+		{name: "unknown volume", volumeID: "vol-2", params: map[string]string{"qosPolicy": "gold"}, wantCode: codes.NotFound},
+		{name: "static volume", volumeID: staticVolumePrefix + "pvc-1", params: map[string]string{"qosPolicy": "gold"}, wantCode: codes.FailedPrecondition},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			api := &fakeAPIClient{handle: func(call fakeCall) (int, interface{}) {
+				if call.method == "PATCH" && call.path == "/api/volumes/vol-1" {
+					return http.StatusOK, testVolume("vol-1", 1<<30)
+				}
+				return http.StatusNotFound, map[string]string{"error": "not found", "code": "not_found"}
+			}}
+			cs := newTestControllerServer(t, api)
+
+			_, err := cs.ControllerModifyVolume(context.Background(), &csi.ControllerModifyVolumeRequest{VolumeId: tt.volumeID, MutableParameters: tt.params})
+			if status.Code(err) != tt.wantCode {
+				t.Fatalf("ControllerModifyVolume returned %v, want %v", err, tt.wantCode)
+			}
+			patches := api.count("PATCH", "/api/volumes/")
+			if tt.wantPayload == "" {
+				// Rejected parameters never reach the backend
+				if tt.wantCode != codes.NotFound && patches != 0 {
+					t.Errorf("backend patched %d times, want none", patches)
+				}
+				return
+			}
+			if patches != 1 {
+				t.Fatalf("backend patched %d times, want 1", patches)
+			}
+			if body := string(api.calls[len(api.calls)-1].body); body != tt.wantPayload {
+				t.Errorf("backend patch payload = %s, want %s", body, tt.wantPayload)
+			}
+		})
+	}
+}
+
+func TestCreateVolumeTopology(t *testing.T) {
+	zoneA := map[string]string{"topology.virium.io/zone": "a"}
+	zoneB := map[string]string{"topology.virium.io/zone": "b"}
+	sanA := map[string]string{"topology.virium.io/network": "san-a"}
+	requirements := &csi.TopologyRequirement{
+		Requisite: []*csi.Topology{{Segments: zoneA}, {Segments: zoneB}},
+		Preferred: []*csi.Topology{{Segments: zoneB}, {Segments: zoneA}},
+	}
+	tests := []struct {
+		name         string
+		requirements *csi.TopologyRequirement
+		backend      []map[string]string
+		portalMap    string
+		want         []map[string]string
+	}{
+		{name: "backend picks the preferred topology", requirements: requirements, backend: []map[string]string{zoneB}, want: []map[string]string{zoneB}},
+		{name: "backend topology wins over the portal map", requirements: requirements, backend: []map[string]string{zoneA}, portalMap: "192.168.0.0/24=topology.virium.io/network=san-a", want: []map[string]string{zoneA}},
+		{name: "portal map without backend topology", portalMap: "192.168.0.0/24=topology.virium.io/network=san-a", want: []map[string]string{sanA}},
+		{name: "no topology", requirements: requirements},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			api := &fakeAPIClient{handle: func(call fakeCall) (int, interface{}) {
+				if call.method == "POST" && call.path == "/api/volumes/create" {
+					vol := testVolume("vol-1", 1<<30)
+					vol.AccessibleTopology = tt.backend
+					return http.StatusCreated, vol
+				}
+				return http.StatusNotFound, map[string]string{"error": "not found", "code": "not_found"}
+			}}
+			cs := newTestControllerServer(t, api)
+			topology, err := parsePortalTopology(tt.portalMap)
+			if err != nil {
+				t.Fatalf("parsePortalTopology failed: %v", err)
+			}
+			cs.Driver.portalTopology = topology
+
+			req := createVolumeRequest("pvc-1", 1<<30)
+			req.AccessibilityRequirements = tt.requirements
+			resp, err := cs.CreateVolume(context.Background(), req)
+			if err != nil {
+				t.Fatalf("CreateVolume failed: %v", err)
+			}
+
+			// The requirements reach the backend in order, it picks the topology
+			var payload VolumeRequest
+			api.lastBody(t, "POST", "/api/volumes/create", &payload)
+			if got, want := fmt.Sprint(payload.RequisiteTopology), fmt.Sprint(topologySegments(tt.requirements.GetRequisite())); got != want {
+				t.Errorf("requisite topology sent as %s, want %s", got, want)
+			}
+			if got, want := fmt.Sprint(payload.PreferredTopology), fmt.Sprint(topologySegments(tt.requirements.GetPreferred())); got != want {
+				t.Errorf("preferred topology sent as %s, want %s", got, want)
+			}
+
+			var got []map[string]string
+			for _, topology := range resp.GetVolume().GetAccessibleTopology() {
+				got = append(got, topology.GetSegments())
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("volume accessible from %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCreateVolumeDefaultPort(t *testing.T) {
+	tests := []struct {
+		name        string
+		defaultPort string
+		params      map[string]string
+		want        string
+	}{
+		{name: "iSCSI default port", defaultPort: "3260", want: "192.168.0.10:3260"},
+		{name: "custom default port", defaultPort: "3261", want: "192.168.0.10:3261"},
+		{name: "StorageClass port wins", defaultPort: "3261", params: map[string]string{"targetPort": "3262"}, want: "192.168.0.10:3262"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setFlag(t, iscsiDefaultPort, tt.defaultPort)
+			cs := newTestControllerServer(t, &fakeAPIClient{handle: newFakeVolumeBackend().handle})
+
+			req := createVolumeRequest("pvc-1", 1<<30)
+			req.Parameters = tt.params
+			resp, err := cs.CreateVolume(context.Background(), req)
+			if err != nil {
+				t.Fatalf("CreateVolume failed: %v", err)
+			}
+			volCtx := resp.GetVolume().GetVolumeContext()
+			if volCtx[volCtxTargetPortal] != tt.want {
+				t.Errorf("target portal = %q, want %q", volCtx[volCtxTargetPortal], tt.want)
+			}
+			if want := `["` + tt.want + `"]`; volCtx[volCtxPortals] != want {
+				t.Errorf("portals = %s, want %s", volCtx[volCtxPortals], want)
+			}
+		})
+	}
+}
@@ -17,23 +17,28 @@ limitations under the License.
 package main
 
 import (
-	"fmt"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
+	"golang.org/x/net/context"
 	klog "k8s.io/klog/v2"
 )
 
 type driver struct {
-	name          string
-	version       string
-	endpoint      string
-	apiURL        string
-	api_username  string
-	api_password  string
-	initiatorName string
-	cap           []*csi.VolumeCapability_AccessMode
-	cscap         []*csi.ControllerServiceCapability
+	name           string
+	version        string
+	endpoint       string
+	initiatorName  string
+	api            apiClient
+	writes         *writeLimiter
+	volumes        *volumeStore
+	portalTopology portalTopology
+	cap            []*csi.VolumeCapability_AccessMode
+	cscap          []*csi.ControllerServiceCapability
 }
 
 const (
@@ -42,42 +47,114 @@ const (
 
 var version = "v0.2.3.4"
 
-func NewDriver(endpoint, apiURL, initiatorName, api_username, api_password string) *driver {
-	klog.V(1).Infof("driver: %s version: %s endpoint: %s api: %s initiator: %s", driverName, version, endpoint, apiURL, initiatorName)
+// gitCommit is injected at build time with -ldflags "-X main.gitCommit=..."
+var gitCommit = "unknown"
+
+func NewDriver(endpoint, apiURL, initiatorName string) *driver {
+	klog.Infof("driver: %s version: %s commit: %s endpoint: %s api: %s initiator: %s", driverName, version, gitCommit, endpoint, apiURL, initiatorName)
+
+	if err := validatePort(*iscsiDefaultPort); err != nil {
+		klog.Fatalf("invalid -iscsi_default_port: %v", err)
+	}
+
+	topology, err := parsePortalTopology(*topologyPortalMap)
+	if err != nil {
+		klog.Fatalf("invalid -topology_portal_map: %v", err)
+	}
+
+	baseURL, err := parseAPIURL(apiURL)
+	if err != nil {
+		klog.Fatalf("invalid -apiurl: %v", err)
+	}
+	var api apiClient
+	if *mockBackend {
+		klog.Warning("using the in-memory mock backend, volumes are not provisioned on Virium")
+		api = newMockAPIClient()
+	} else {
+		api, err = newHTTPAPIClient(baseURL)
+		if err != nil {
+			klog.Fatalf("failed to configure the Virium api client: %v", err)
+		}
+	}
 
 	d := &driver{
-		name:          driverName,
-		version:       version,
-		endpoint:      endpoint,
-		apiURL:        apiURL,
-		initiatorName: initiatorName,
-		api_username:  api_username,
-		api_password:  api_password,
+		name:           driverName,
+		version:        version,
+		endpoint:       endpoint,
+		initiatorName:  initiatorName,
+		api:            api,
+		writes:         newWriteLimiter(*apiMaxInflightWrites),
+		portalTopology: topology,
 	}
 
-	if err := os.MkdirAll(fmt.Sprintf("/var/run/%s", driverName), 0o755); err != nil {
+	if err := os.MkdirAll(filepath.Dir(*volumeStorePath), 0o755); err != nil {
 		panic(err)
 	}
+	d.volumes, err = newVolumeStore(*volumeStorePath, *volumeStoreLegacyPath)
+	if err != nil {
+		klog.Fatalf("failed to load the volume store: %v", err)
+	}
 	d.AddVolumeCapabilityAccessModes([]csi.VolumeCapability_AccessMode_Mode{csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER})
 
 	d.AddControllerServiceCapabilities([]csi.ControllerServiceCapability_RPC_Type{
 		csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
+		csi.ControllerServiceCapability_RPC_LIST_VOLUMES,
 		csi.ControllerServiceCapability_RPC_SINGLE_NODE_MULTI_WRITER,
 		csi.ControllerServiceCapability_RPC_CLONE_VOLUME,
 		csi.ControllerServiceCapability_RPC_CREATE_DELETE_SNAPSHOT,
+		csi.ControllerServiceCapability_RPC_LIST_SNAPSHOTS,
 		csi.ControllerServiceCapability_RPC_EXPAND_VOLUME,
 		csi.ControllerServiceCapability_RPC_PUBLISH_UNPUBLISH_VOLUME,
+		csi.ControllerServiceCapability_RPC_GET_VOLUME,
+		csi.ControllerServiceCapability_RPC_GET_CAPACITY,
+		csi.ControllerServiceCapability_RPC_VOLUME_CONDITION,
+		csi.ControllerServiceCapability_RPC_MODIFY_VOLUME,
 	})
 
 	return d
 }
 
 func (d *driver) Run() {
+	if *metricsAddress != "" {
+		go serveMetrics(*metricsAddress)
+	}
+	if *healthAddress != "" {
+		go d.serveHealth(*healthAddress)
+	}
+	cs := NewControllerServer(d)
+	if err := cs.reconcileVolumeStore(context.Background()); err != nil {
+		klog.Warningf("failed to reconcile the volume store with the backend: %v", err)
+	}
+
 	s := NewNonBlockingGRPCServer()
 	s.Start(d.endpoint,
 		NewDefaultIdentityServer(d),
-		NewControllerServer(d),
+		cs,
 		nil)
+	stopOnSignal(s, *shutdownTimeout)
+}
+
+// stopOnSignal blocks until SIGTERM or SIGINT, then lets in-flight calls finish
+// for up to timeout before cancelling them, so a rolling upgrade doesn't abort
+// a backend call halfway and leak its volume
+func stopOnSignal(s NonBlockingGRPCServer, timeout time.Duration) {
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGTERM, syscall.SIGINT)
+	sig := <-sigCh
+	klog.Infof("received %v, draining in-flight requests for up to %v", sig, timeout)
+
+	drained := make(chan struct{})
+	go func() {
+		s.Stop()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+		klog.Info("in-flight requests drained")
+	case <-time.After(timeout):
+		klog.Warningf("in-flight requests still running after %v, cancelling them", timeout)
+		s.ForceStop()
+	}
 	s.Wait()
 }
 
@@ -0,0 +1,75 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"golang.org/x/net/context"
+)
+
+func TestDriverCapabilities(t *testing.T) {
+	setFlag(t, mockBackend, true)
+	setFlag(t, volumeStorePath, filepath.Join(t.TempDir(), "volumes.json"))
+	setFlag(t, volumeStoreLegacyPath, "")
+	d := NewDriver("unix:///csi/csi.sock", "http://virium.local:8787", "iqn.2025-04.net.virer.virium:controller")
+
+	cs := NewControllerServer(d)
+	resp, err := cs.ControllerGetCapabilities(context.Background(), &csi.ControllerGetCapabilitiesRequest{})
+	if err != nil {
+		t.Fatalf("ControllerGetCapabilities failed: %v", err)
+	}
+	want := []csi.ControllerServiceCapability_RPC_Type{
+		csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
+		csi.ControllerServiceCapability_RPC_LIST_VOLUMES,
+		csi.ControllerServiceCapability_RPC_SINGLE_NODE_MULTI_WRITER,
+		csi.ControllerServiceCapability_RPC_CLONE_VOLUME,
+		csi.ControllerServiceCapability_RPC_CREATE_DELETE_SNAPSHOT,
+		csi.ControllerServiceCapability_RPC_LIST_SNAPSHOTS,
+		csi.ControllerServiceCapability_RPC_EXPAND_VOLUME,
+		csi.ControllerServiceCapability_RPC_PUBLISH_UNPUBLISH_VOLUME,
+		csi.ControllerServiceCapability_RPC_GET_VOLUME,
+		csi.ControllerServiceCapability_RPC_GET_CAPACITY,
+		csi.ControllerServiceCapability_RPC_VOLUME_CONDITION,
+		csi.ControllerServiceCapability_RPC_MODIFY_VOLUME,
+	}
+	var got []csi.ControllerServiceCapability_RPC_Type
+	for _, c := range resp.GetCapabilities() {
+		got = append(got, c.GetRpc().GetType())
+	}
+	if len(got) != len(want) {
+		t.Fatalf("ControllerGetCapabilities returned %v, want %v", got, want)
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			t.Errorf("ControllerGetCapabilities returned %v, want %v", got, want)
+			break
+		}
+	}
+
+	ids := NewDefaultIdentityServer(d)
+	pluginResp, err := ids.GetPluginCapabilities(context.Background(), &csi.GetPluginCapabilitiesRequest{})
+	if err != nil {
+		t.Fatalf("GetPluginCapabilities failed: %v", err)
+	}
+	caps := pluginResp.GetCapabilities()
+	if len(caps) != 1 || caps[0].GetService().GetType() != csi.PluginCapability_Service_CONTROLLER_SERVICE {
+		t.Errorf("GetPluginCapabilities returned %v, want CONTROLLER_SERVICE only", caps)
+	}
+}
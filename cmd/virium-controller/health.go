@@ -0,0 +1,58 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"golang.org/x/net/context"
+	klog "k8s.io/klog/v2"
+)
+
+// readinessTimeout bounds the Virium api ping done by /readyz
+const readinessTimeout = 5 * time.Second
+
+// serveHealth exposes /healthz, which only tells the process is up,
+// and /readyz, which fails while the Virium api can't be reached
+func (d *driver) serveHealth(address string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), readinessTimeout)
+		defer cancel()
+
+		apiPath := "/api/health"
+		if _, err := d.viriumHttpClient(ctx, "GET", apiPath, nil); err != nil {
+			klog.V(2).Infof("readiness check failed: %v", err)
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintf(w, "Virium api unreachable: %v\n", err)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintln(w, "ok")
+	})
+
+	klog.Infof("serving health checks on address: %s", address)
+	if err := http.ListenAndServe(address, mux); err != nil {
+		klog.Fatalf("failed to serve health checks: %v", err)
+	}
+}
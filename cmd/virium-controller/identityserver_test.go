@@ -0,0 +1,61 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"golang.org/x/net/context"
+)
+
+func TestGetPluginCapabilities(t *testing.T) {
+	tests := []struct {
+		name           string
+		enableTopology bool
+		want           []csi.PluginCapability_Service_Type
+	}{
+		{name: "default", want: []csi.PluginCapability_Service_Type{csi.PluginCapability_Service_CONTROLLER_SERVICE}},
+		{name: "topology enabled", enableTopology: true, want: []csi.PluginCapability_Service_Type{
+			csi.PluginCapability_Service_CONTROLLER_SERVICE,
+			csi.PluginCapability_Service_VOLUME_ACCESSIBILITY_CONSTRAINTS,
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setFlag(t, enableTopology, tt.enableTopology)
+			ids := &IdentityServer{Driver: &driver{name: driverName, version: version}}
+
+			resp, err := ids.GetPluginCapabilities(context.Background(), &csi.GetPluginCapabilitiesRequest{})
+			if err != nil {
+				t.Fatalf("GetPluginCapabilities failed: %v", err)
+			}
+			var got []csi.PluginCapability_Service_Type
+			for _, c := range resp.GetCapabilities() {
+				got = append(got, c.GetService().GetType())
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("GetPluginCapabilities returned %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("GetPluginCapabilities returned %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,111 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"golang.org/x/net/context"
+	klog "k8s.io/klog/v2"
+)
+
+// jobPollMaxDelay caps the backoff between two job status polls
+const jobPollMaxDelay = 10 * time.Second
+
+// JobResponse is the status of an asynchronous backend operation,
+// returned by the 202 Accepted response and by GET /api/jobs/{id}
+type JobResponse struct {
+	JobID  string `json:"job_id"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+	Code   string `json:"code,omitempty"`
+	// Result holds the final object, e.g. the VolumeResponse of a create
+	Result json.RawMessage `json:"result,omitempty"`
+}
+
+// viriumJobRequest calls the Virium API like viriumHttpClient, and when the backend
+// accepts the request as a job it waits for the job and returns its result
+func (d *driver) viriumJobRequest(ctx context.Context, method string, path string, jsonData []byte) ([]byte, error) {
+	body, statusCode, err := d.api.Do(ctx, method, path, jsonData)
+	if err != nil || statusCode != http.StatusAccepted {
+		return body, err
+	}
+
+	var job JobResponse
+	if err := json.NewDecoder(bytes.NewReader(body)).Decode(&job); err != nil {
+		return nil, fmt.Errorf("failed to parse job response: %v", err)
+	}
+	if job.JobID == "" {
+		return nil, fmt.Errorf("accepted response carries no job id")
+	}
+	return d.waitForJob(ctx, job.JobID)
+}
+
+// waitForJob polls a backend job with exponential backoff until it completes,
+// the request deadline, or -api_job_timeout without one, bounds the wait
+func (d *driver) waitForJob(ctx context.Context, jobID string) ([]byte, error) {
+	logger := klog.FromContext(ctx)
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *apiJobTimeout)
+		defer cancel()
+	}
+
+	apiPath := fmt.Sprintf("/api/jobs/%s", url.PathEscape(jobID))
+	delay := *apiRetryDelay
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("job %s did not complete: %w", jobID, ctx.Err())
+		case <-time.After(delay):
+		}
+		if delay *= 2; delay > jobPollMaxDelay {
+			delay = jobPollMaxDelay
+		}
+
+		body, err := d.viriumHttpClient(ctx, "GET", apiPath, nil)
+		if err != nil {
+			if ctx.Err() != nil {
+				continue
+			}
+			return nil, err
+		}
+		var job JobResponse
+		if err := json.NewDecoder(bytes.NewReader(body)).Decode(&job); err != nil {
+			return nil, fmt.Errorf("failed to parse job response: %v", err)
+		}
+
+		switch job.Status {
+		case "succeeded", "completed":
+			logger.V(2).Info("Job completed", "jobID", jobID)
+			return job.Result, nil
+		case "failed":
+			return nil, &apiError{
+				statusCode: http.StatusInternalServerError,
+				body:       string(body),
+				code:       job.Code,
+				message:    fmt.Sprintf("job %s failed: %s", jobID, job.Error),
+			}
+		}
+		logger.V(5).Info("Waiting for job", "jobID", jobID, "status", job.Status, "delay", delay)
+	}
+}
@@ -0,0 +1,94 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func TestViriumJobRequest(t *testing.T) {
+	setFlag(t, apiRetryDelay, time.Millisecond)
+	setFlag(t, apiJobTimeout, 50*time.Millisecond)
+
+	tests := []struct {
+		name string
+		// job answers the polls of job-1 in order, the last one repeats
+		job       []JobResponse
+		accepted  interface{}
+		want      string
+		wantPolls int
+		wantErr   bool
+	}{
+		{name: "synchronous response", want: `{"id":"vol-1"}`},
+		{
+			name:      "accepted then completed",
+			accepted:  JobResponse{JobID: "job-1", Status: "queued"},
+			job:       []JobResponse{{Status: "queued"}, {Status: "running"}, {Status: "completed", Result: []byte(`{"id":"vol-1"}`)}},
+			want:      `{"id":"vol-1"}`,
+			wantPolls: 3,
+		},
+		{
+			name:      "accepted then failed",
+			accepted:  JobResponse{JobID: "job-1", Status: "queued"},
+			job:       []JobResponse{{Status: "failed", Error: "lvcreate failed"}},
+			wantPolls: 1,
+			wantErr:   true,
+		},
+		{name: "accepted without a job id", accepted: JobResponse{Status: "queued"}, wantErr: true},
+		{
+			name:     "job never completes without a request deadline",
+			accepted: JobResponse{JobID: "job-1", Status: "queued"},
+			job:      []JobResponse{{Status: "running"}},
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			polls := 0
+			api := &fakeAPIClient{handle: func(call fakeCall) (int, interface{}) {
+				switch {
+				case call.method == "POST" && call.path == "/api/volumes/create":
+					if tt.accepted == nil {
+						return http.StatusCreated, []byte(`{"id":"vol-1"}`)
+					}
+					return http.StatusAccepted, tt.accepted
+				case call.method == "GET" && call.path == "/api/jobs/job-1":
+					job := tt.job[min(polls, len(tt.job)-1)]
+					polls++
+					return http.StatusOK, job
+				}
+				return http.StatusNotFound, nil
+			}}
+			cs := newTestControllerServer(t, api)
+
+			got, err := cs.Driver.viriumJobRequest(context.Background(), "POST", "/api/volumes/create", []byte(`{}`))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("viriumJobRequest returned %v, want error %v", err, tt.wantErr)
+			}
+			if string(got) != tt.want {
+				t.Errorf("viriumJobRequest returned %q, want %q", got, tt.want)
+			}
+			if tt.wantPolls > 0 && polls != tt.wantPolls {
+				t.Errorf("job polled %d times, want %d", polls, tt.wantPolls)
+			}
+		})
+	}
+}
@@ -19,16 +19,50 @@ package main
 import (
 	"flag"
 	"os"
+	"time"
 
 	klog "k8s.io/klog/v2"
 )
 
 var (
-	endpoint      = flag.String("endpoint", "unix:///csi/csi.sock", "CSI endpoint")
-	apiURL        = flag.String("apiurl", "http://virium-isci-fqdn.domain.tld:8787", "Virium api url")
-	initiatorName = flag.String("initiatorname", "iqn.2025-04.net.virer.virium:target1", "iSCSI initiator name identifier")
-	api_username  = flag.String("api_username", "", "api_username")
-	api_password  = flag.String("api_password", "", "api_password")
+	endpoint                = flag.String("endpoint", "unix:///csi/csi.sock", "CSI endpoint")
+	apiURL                  = flag.String("apiurl", "http://virium-isci-fqdn.domain.tld:8787", "Virium api url")
+	initiatorName           = flag.String("initiatorname", "iqn.2025-04.net.virer.virium:target1", "iSCSI initiator name identifier")
+	nodeInitiatorFormat     = flag.String("node_initiator_format", "", "Initiator allowed to log in from a node whose node ID is not an IQN, %s is replaced by the node ID, e.g. iqn.2025-04.net.virer.virium:%s")
+	apiUsername             = flag.String("api_username", "", "api_username")
+	apiPassword             = flag.String("api_password", "", "api_password")
+	apiTokenFile            = flag.String("api_token_file", "", "File holding the Virium api token, takes precedence over the VIRIUM_API_TOKEN environment variable")
+	apiTokenHeader          = flag.String("api_token_header", "Authorization", "HTTP header carrying the Virium api token, Authorization sends it as a Bearer token")
+	apiCAFile               = flag.String("api_ca_file", "", "CA bundle used to verify the Virium api certificate")
+	apiCertFile             = flag.String("api_cert_file", "", "Client certificate for mutual TLS with the Virium api")
+	apiKeyFile              = flag.String("api_key_file", "", "Client certificate key for mutual TLS with the Virium api")
+	apiInsecureSkipVerify   = flag.Bool("api_insecure_skip_verify", false, "Skip the Virium api certificate verification, for test environments only")
+	apiProxy                = flag.String("api_proxy", "", "Proxy url used to reach the Virium api, overrides HTTP_PROXY, HTTPS_PROXY and NO_PROXY")
+	apiMaxIdleConns         = flag.Int("api_max_idle_conns", 100, "Maximum number of idle connections kept to the Virium api")
+	apiMaxIdleConnsPerHost  = flag.Int("api_max_idle_conns_per_host", 32, "Maximum number of idle connections kept per Virium api host")
+	apiIdleConnTimeout      = flag.Duration("api_idle_conn_timeout", 90*time.Second, "Time an idle connection to the Virium api is kept open")
+	metricsAddress          = flag.String("metrics_address", "", "Address to serve prometheus metrics on, e.g. :8080, disabled when empty")
+	healthAddress           = flag.String("health_address", "", "Address to serve /healthz and /readyz on, e.g. :9808, disabled when empty")
+	extraFsTypes            = flag.String("extra_fstypes", "", "Comma separated filesystem types accepted in addition to ext2, ext3, ext4 and xfs")
+	ignoreUnknownParameters = flag.Bool("ignore_unknown_parameters", true, "Accept StorageClass parameters unknown to this driver version with a warning, false rejects them")
+	maxVolumeSize           = flag.Int64("max_volume_size", 0, "Maximum volume size in bytes accepted for create and expand, unlimited when 0")
+	minVolumeSize           = flag.Int64("min_volume_size", 0, "Minimum volume size in bytes, smaller requests are raised to it")
+	volumeSizeGranularity   = flag.Int64("volume_size_granularity", 0, "Volume sizes are rounded up to a multiple of this many bytes, e.g. 1073741824 for 1GiB, disabled when 0")
+	volumeNamePrefix        = flag.String("volume_name_prefix", "", "Prefix of the volume names created on the Virium backend, e.g. cluster1-")
+	topologyPortalMap       = flag.String("topology_portal_map", "", "Comma separated subnet=key=value entries tagging volumes with the topology segment of their portal subnet, e.g. 10.0.1.0/24=topology.virium.io/network=san-a")
+	enableTopology          = flag.Bool("enable_topology", false, "Advertise VOLUME_ACCESSIBILITY_CONSTRAINTS, enable only when the node plugin reports the topology keys used by the backend or -topology_portal_map")
+	iscsiDefaultPort        = flag.String("iscsi_default_port", "3260", "iSCSI port published for target portals that don't specify one")
+	volumeStorePath         = flag.String("volume_store_path", "/var/lib/virium.csi.virer.net/volumes.json", "File mapping CSI names to backend IDs, it must be on a persistent volume so that it survives a controller reschedule")
+	volumeStoreLegacyPath   = flag.String("volume_store_legacy_path", "/var/run/virium.csi.virer.net/volumes.json", "Volume store read when -volume_store_path doesn't exist yet, e.g. after an upgrade, disabled when empty")
+	shutdownTimeout         = flag.Duration("shutdown_timeout", 30*time.Second, "Time given to in-flight requests to finish on SIGTERM before they are cancelled")
+	forceDelete             = flag.Bool("force_delete", false, "Delete volumes that are still published on nodes, for cleanup only")
+	mockBackend             = flag.Bool("mock_backend", false, "Serve the Virium api from memory, for csi-sanity runs only")
+	apiTimeout              = flag.Duration("api_timeout", 30*time.Second, "Virium api request timeout, used when the CSI call has no deadline")
+	apiJobTimeout           = flag.Duration("api_job_timeout", 5*time.Minute, "Time to wait for an asynchronous Virium api job, used when the CSI call has no deadline")
+	apiUserAgent            = flag.String("api_user_agent", "", "User-Agent sent to the Virium api, defaults to virium-csi-driver-iscsi/<version> (controller)")
+	apiMaxRetries           = flag.Int("api_max_retries", 3, "Maximum number of retries for transient Virium api failures")
+	apiRetryDelay           = flag.Duration("api_retry_delay", 500*time.Millisecond, "Base delay of the Virium api retry exponential backoff")
+	apiMaxInflightWrites    = flag.Int("api_max_inflight_writes", 16, "Maximum number of concurrent create and delete calls to the Virium api, further calls wait for a free slot, unlimited when 0")
 )
 
 func main() {
@@ -40,6 +74,6 @@ func main() {
 }
 
 func handle() {
-	d := NewDriver(*endpoint, *apiURL, *initiatorName, *api_username, *api_password)
+	d := NewDriver(*endpoint, *apiURL, *initiatorName)
 	d.Run()
 }
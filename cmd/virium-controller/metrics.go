@@ -0,0 +1,79 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+	"runtime"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+	klog "k8s.io/klog/v2"
+)
+
+var (
+	metricsRegistry = prometheus.NewRegistry()
+
+	operationsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "virium_csi_operations_total",
+		Help: "Number of CSI operations by method and result code.",
+	}, []string{"method", "code"})
+
+	operationDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "virium_csi_operation_duration_seconds",
+		Help:    "Duration of CSI operations by method.",
+		Buckets: prometheus.ExponentialBuckets(0.05, 2, 12),
+	}, []string{"method"})
+
+	apiErrorsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "virium_api_errors_total",
+		Help: "Number of failed Virium api requests by HTTP method.",
+	}, []string{"method"})
+
+	buildInfo = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "virium_build_info",
+		Help: "Build information of the running driver, always 1.",
+	}, []string{"version", "git_commit", "go_version"})
+)
+
+func init() {
+	metricsRegistry.MustRegister(operationsTotal, operationDuration, apiErrorsTotal, buildInfo)
+	buildInfo.WithLabelValues(version, gitCommit, runtime.Version()).Set(1)
+}
+
+// metricsGRPC records the count, result code and latency of every CSI call
+func metricsGRPC(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	start := time.Now()
+	resp, err := handler(ctx, req)
+	operationDuration.WithLabelValues(info.FullMethod).Observe(time.Since(start).Seconds())
+	operationsTotal.WithLabelValues(info.FullMethod, status.Code(err).String()).Inc()
+	return resp, err
+}
+
+// serveMetrics exposes the metrics registry on the given address
+func serveMetrics(address string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{}))
+	klog.Infof("serving metrics on address: %s", address)
+	if err := http.ListenAndServe(address, mux); err != nil {
+		klog.Fatalf("failed to serve metrics: %v", err)
+	}
+}
@@ -0,0 +1,342 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// mockCapacity is the pool size reported by the mock backend
+const mockCapacity = 1 << 40
+
+// mockAPIClient is an in-memory Virium API selected by -mock_backend, so that
+// csi-sanity can run without a real backend. It is never used otherwise
+type mockAPIClient struct {
+	mu            sync.Mutex
+	nextID        int
+	volumes       map[string]*VolumeResponse
+	volumeNames   map[string]string
+	snapshots     map[string]*SnapshotResponse
+	snapshotNames map[string]string
+}
+
+func newMockAPIClient() *mockAPIClient {
+	return &mockAPIClient{
+		volumes:       map[string]*VolumeResponse{},
+		volumeNames:   map[string]string{},
+		snapshots:     map[string]*SnapshotResponse{},
+		snapshotNames: map[string]string{},
+	}
+}
+
+func (m *mockAPIClient) Do(ctx context.Context, method, path string, body []byte) ([]byte, int, error) {
+	u, err := url.Parse(path)
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid api path %q: %v", path, err)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	p := u.Path
+	switch {
+	case method == "GET" && p == "/api/health":
+		return m.reply(http.StatusOK, map[string]string{"status": "ok"})
+	case method == "GET" && p == "/api/capacity":
+		return m.reply(http.StatusOK, CapacityResponse{AvailableCapacity: mockCapacity - m.usedCapacity()})
+
+	case method == "POST" && (p == "/api/volumes/create" || p == "/api/volumes/create-from-snapshot" || p == "/api/volumes/clone"):
+		return m.createVolume(body)
+	case method == "POST" && p == "/api/volumes/resize":
+		var req VolumeResizeRequest
+		if err := json.Unmarshal(body, &req); err != nil {
+			return m.fail(http.StatusBadRequest, "invalid_request", err.Error())
+		}
+		vol, ok := m.volumes[req.VolumeID]
+		if !ok {
+			return m.fail(http.StatusNotFound, "not_found", "volume "+req.VolumeID+" not found")
+		}
+		if req.Capacity > vol.Capacity {
+			vol.Capacity = req.Capacity
+		}
+		return m.reply(http.StatusOK, vol)
+	case method == "DELETE" && p == "/api/volumes/delete":
+		var req DeleteVolumeRequest
+		if err := json.Unmarshal(body, &req); err != nil {
+			return m.fail(http.StatusBadRequest, "invalid_request", err.Error())
+		}
+		if _, ok := m.volumes[req.VolumeID]; !ok {
+			return m.fail(http.StatusNotFound, "not_found", "volume "+req.VolumeID+" not found")
+		}
+		delete(m.volumes, req.VolumeID)
+		for name, id := range m.volumeNames {
+			if id == req.VolumeID {
+				delete(m.volumeNames, name)
+			}
+		}
+		return nil, http.StatusNoContent, nil
+	case method == "GET" && p == "/api/volumes/list":
+		var volumes []*VolumeResponse
+		for _, id := range sortedKeys(m.volumes) {
+			volumes = append(volumes, m.volumes[id])
+		}
+		return m.reply(http.StatusOK, page(volumes, u.Query(), func(v *VolumeResponse) string { return v.VolumeID }))
+	case method == "GET" && strings.HasPrefix(p, "/api/volumes/by-name/"):
+		id, ok := m.volumeNames[strings.TrimPrefix(p, "/api/volumes/by-name/")]
+		if !ok {
+			return m.fail(http.StatusNotFound, "not_found", "volume not found")
+		}
+		return m.reply(http.StatusOK, m.volumes[id])
+	case method == "POST" && strings.HasPrefix(p, "/api/volumes/") && (strings.HasSuffix(p, "/attach") || strings.HasSuffix(p, "/detach")):
+		return m.attach(strings.TrimPrefix(p, "/api/volumes/"), body)
+	case method == "PATCH" && strings.HasPrefix(p, "/api/volumes/"):
+		var req VolumeModifyRequest
+		if err := json.Unmarshal(body, &req); err != nil {
+			return m.fail(http.StatusBadRequest, "invalid_request", err.Error())
+		}
+		vol, ok := m.volumes[strings.TrimPrefix(p, "/api/volumes/")]
+		if !ok {
+			return m.fail(http.StatusNotFound, "not_found", "volume not found")
+		}
+		if req.QosPolicy != "" {
+			vol.QosPolicy = req.QosPolicy
+		}
+		if req.IopsLimit != nil {
+			vol.IopsLimit = req.IopsLimit
+		}
+		if req.BandwidthLimit != nil {
+			vol.BandwidthLimit = req.BandwidthLimit
+		}
+		return m.reply(http.StatusOK, vol)
+	case method == "GET" && strings.HasPrefix(p, "/api/volumes/"):
+		vol, ok := m.volumes[strings.TrimPrefix(p, "/api/volumes/")]
+		if !ok {
+			return m.fail(http.StatusNotFound, "not_found", "volume not found")
+		}
+		return m.reply(http.StatusOK, vol)
+
+	case method == "POST" && p == "/api/snapshot/create":
+		return m.createSnapshot(body)
+	case method == "DELETE" && p == "/api/snapshot/delete":
+		var req DeleteSnapshotRequest
+		if err := json.Unmarshal(body, &req); err != nil {
+			return m.fail(http.StatusBadRequest, "invalid_request", err.Error())
+		}
+		if _, ok := m.snapshots[req.SnapshotID]; !ok {
+			return m.fail(http.StatusNotFound, "not_found", "snapshot "+req.SnapshotID+" not found")
+		}
+		delete(m.snapshots, req.SnapshotID)
+		for name, id := range m.snapshotNames {
+			if id == req.SnapshotID {
+				delete(m.snapshotNames, name)
+			}
+		}
+		return nil, http.StatusNoContent, nil
+	case method == "GET" && p == "/api/snapshot/list":
+		query := u.Query()
+		var snapshots []*SnapshotResponse
+		for _, id := range sortedKeys(m.snapshots) {
+			snap := m.snapshots[id]
+			if source := query.Get("source_volume_id"); source != "" && snap.SourceVolumeID != source {
+				continue
+			}
+			if snapshotID := query.Get("snapshot_id"); snapshotID != "" && snap.VolumeID != snapshotID {
+				continue
+			}
+			snapshots = append(snapshots, snap)
+		}
+		return m.reply(http.StatusOK, page(snapshots, query, func(s *SnapshotResponse) string { return s.VolumeID }))
+	case method == "GET" && strings.HasPrefix(p, "/api/snapshot/by-name/"):
+		id, ok := m.snapshotNames[strings.TrimPrefix(p, "/api/snapshot/by-name/")]
+		if !ok {
+			return m.fail(http.StatusNotFound, "not_found", "snapshot not found")
+		}
+		return m.reply(http.StatusOK, m.snapshots[id])
+	case method == "GET" && strings.HasPrefix(p, "/api/snapshot/"):
+		snap, ok := m.snapshots[strings.TrimPrefix(p, "/api/snapshot/")]
+		if !ok {
+			return m.fail(http.StatusNotFound, "not_found", "snapshot not found")
+		}
+		return m.reply(http.StatusOK, snap)
+	}
+	return m.fail(http.StatusNotFound, "not_found", fmt.Sprintf("no mock handler for %s %s", method, p))
+}
+
+func (m *mockAPIClient) createVolume(body []byte) ([]byte, int, error) {
+	var req VolumeRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		return m.fail(http.StatusBadRequest, "invalid_request", err.Error())
+	}
+	if id, ok := m.volumeNames[req.Name]; ok {
+		return m.reply(http.StatusOK, m.volumes[id])
+	}
+	if req.SnapshotID != "" {
+		if _, ok := m.snapshots[req.SnapshotID]; !ok {
+			return m.fail(http.StatusNotFound, "not_found", "snapshot "+req.SnapshotID+" not found")
+		}
+	}
+	if req.SourceVolumeID != "" {
+		if _, ok := m.volumes[req.SourceVolumeID]; !ok {
+			return m.fail(http.StatusNotFound, "not_found", "volume "+req.SourceVolumeID+" not found")
+		}
+	}
+	if req.Capacity > mockCapacity-m.usedCapacity() {
+		return m.fail(http.StatusInsufficientStorage, "quota_exceeded", "not enough space in the mock pool")
+	}
+
+	m.nextID++
+	id := fmt.Sprintf("mock-vol-%06d", m.nextID)
+	vol := &VolumeResponse{
+		VolumeID:          id,
+		Name:              req.Name,
+		TargetPortal:      "127.0.0.1:3260",
+		Iqn:               "iqn.2025-04.net.virer.virium:" + id,
+		Lun:               "0",
+		DiscoveryCHAPAuth: "false",
+		SessionCHAPAuth:   "false",
+		Capacity:          req.Capacity,
+		SnapshotID:        req.SnapshotID,
+		SourceVolumeID:    req.SourceVolumeID,
+		QosPolicy:         req.QosPolicy,
+		IopsLimit:         req.IopsLimit,
+		BandwidthLimit:    req.BandwidthLimit,
+	}
+	m.volumes[id] = vol
+	m.volumeNames[req.Name] = id
+	return m.reply(http.StatusCreated, vol)
+}
+
+func (m *mockAPIClient) attach(rest string, body []byte) ([]byte, int, error) {
+	var req AttachRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		return m.fail(http.StatusBadRequest, "invalid_request", err.Error())
+	}
+	detach := strings.HasSuffix(rest, "/detach")
+	id := strings.TrimSuffix(strings.TrimSuffix(rest, "/attach"), "/detach")
+	vol, ok := m.volumes[id]
+	if !ok {
+		return m.fail(http.StatusNotFound, "not_found", "volume "+id+" not found")
+	}
+
+	// Like the real backend, an attach that is already done or that would
+	// share a single-node volume is refused
+	if !detach {
+		for _, node := range vol.PublishedNodeIDs {
+			if node == req.NodeID || !req.MultiAttach {
+				return m.fail(http.StatusConflict, "conflict", "volume "+id+" is attached to node "+node)
+			}
+		}
+	}
+
+	nodes := []string{}
+	attachments := []VolumeAttachment{}
+	for _, a := range vol.Attachments {
+		if a.NodeID != req.NodeID {
+			nodes = append(nodes, a.NodeID)
+			attachments = append(attachments, a)
+		}
+	}
+	if !detach {
+		nodes = append(nodes, req.NodeID)
+		attachments = append(attachments, VolumeAttachment{NodeID: req.NodeID, InitiatorName: req.InitiatorName})
+	}
+	vol.PublishedNodeIDs = nodes
+	vol.Attachments = attachments
+	return m.reply(http.StatusOK, AttachResponse{})
+}
+
+func (m *mockAPIClient) createSnapshot(body []byte) ([]byte, int, error) {
+	var req SnapshotRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		return m.fail(http.StatusBadRequest, "invalid_request", err.Error())
+	}
+	if id, ok := m.snapshotNames[req.Name]; ok {
+		return m.reply(http.StatusOK, m.snapshots[id])
+	}
+	vol, ok := m.volumes[req.VolumeID]
+	if !ok {
+		return m.fail(http.StatusNotFound, "not_found", "volume "+req.VolumeID+" not found")
+	}
+
+	m.nextID++
+	id := fmt.Sprintf("mock-snap-%06d", m.nextID)
+	snap := &SnapshotResponse{
+		VolumeID:       id,
+		Name:           req.Name,
+		Capacity:       vol.Capacity,
+		SourceVolumeID: vol.VolumeID,
+		CreationTime:   time.Now(),
+	}
+	m.snapshots[id] = snap
+	m.snapshotNames[req.Name] = id
+	return m.reply(http.StatusCreated, snap)
+}
+
+func (m *mockAPIClient) usedCapacity() int64 {
+	var used int64
+	for _, vol := range m.volumes {
+		used += vol.Capacity
+	}
+	return used
+}
+
+func (m *mockAPIClient) reply(statusCode int, v interface{}) ([]byte, int, error) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to marshal mock response: %v", err)
+	}
+	return body, statusCode, nil
+}
+
+// fail answers like the real backend, so the caller sees an *apiError with its envelope
+func (m *mockAPIClient) fail(statusCode int, code, message string) ([]byte, int, error) {
+	body, _ := json.Marshal(map[string]string{"error": message, "code": code})
+	return nil, statusCode, newAPIError(statusCode, body)
+}
+
+func sortedKeys[T any](items map[string]T) []string {
+	keys := make([]string, 0, len(items))
+	for key := range items {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// page applies the after and limit list query parameters to items sorted by ID
+func page[T any](items []T, query url.Values, id func(T) string) []T {
+	if after := query.Get("after"); after != "" {
+		start := sort.Search(len(items), func(i int) bool { return id(items[i]) > after })
+		items = items[start:]
+	}
+	if limit, _ := strconv.Atoi(query.Get("limit")); limit > 0 && limit < len(items) {
+		items = items[:limit]
+	}
+	if items == nil {
+		items = []T{}
+	}
+	return items
+}
@@ -50,6 +50,12 @@ type nonBlockingGRPCServer struct {
 }
 
 func (s *nonBlockingGRPCServer) Start(endpoint string, ids csi.IdentityServer, cs csi.ControllerServer, ns csi.NodeServer) {
+	// The server is created before returning so that Stop can't race with serve
+	opts := []grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(requestIDGRPC, logGRPC, metricsGRPC),
+	}
+	s.server = grpc.NewServer(opts...)
+
 	s.wg.Add(1)
 
 	go s.serve(endpoint, ids, cs, ns)
@@ -68,6 +74,8 @@ func (s *nonBlockingGRPCServer) ForceStop() {
 }
 
 func (s *nonBlockingGRPCServer) serve(endpoint string, ids csi.IdentityServer, cs csi.ControllerServer, ns csi.NodeServer) {
+	defer s.wg.Done()
+
 	proto, addr, err := ParseEndpoint(endpoint)
 	if err != nil {
 		klog.Fatal(err.Error())
@@ -85,11 +93,7 @@ func (s *nonBlockingGRPCServer) serve(endpoint string, ids csi.IdentityServer, c
 		klog.Fatalf("failed to listen: %v", err)
 	}
 
-	opts := []grpc.ServerOption{
-		grpc.UnaryInterceptor(logGRPC),
-	}
-	server := grpc.NewServer(opts...)
-	s.server = server
+	server := s.server
 
 	if ids != nil {
 		csi.RegisterIdentityServer(server, ids)
@@ -18,17 +18,35 @@ package main
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"math/rand"
+	"net"
 	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/google/uuid"
 	"github.com/kubernetes-csi/csi-lib-utils/protosanitizer"
 	"golang.org/x/net/context"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
 	klog "k8s.io/klog/v2"
 )
 
@@ -40,7 +58,8 @@ func NewDefaultIdentityServer(d *driver) *IdentityServer {
 
 func NewControllerServer(d *driver) *ControllerServer {
 	return &ControllerServer{
-		Driver: d,
+		Driver:      d,
+		volumeLocks: NewVolumeLocks(),
 	}
 }
 
@@ -64,75 +83,894 @@ func ParseEndpoint(ep string) (string, string, error) {
 	return "", "", fmt.Errorf("invalid endpoint: %v", ep)
 }
 
+// redactSecrets returns a copy of a string map safe to log, masking the values
+// of keys that may hold credentials such as CHAP passwords or the node "secret" blob
+func redactSecrets(m map[string]string) map[string]string {
+	redacted := make(map[string]string, len(m))
+	for k, v := range m {
+		lk := strings.ToLower(k)
+		if strings.Contains(lk, "secret") || strings.Contains(lk, "password") || strings.Contains(lk, "token") {
+			v = "***stripped***"
+		}
+		redacted[k] = v
+	}
+	return redacted
+}
+
+// requestIDKey is the context key of the correlation id of a CSI call
+type requestIDKey struct{}
+
+// requestIDGRPC attaches a correlation id to every CSI call, reusing the one sent by
+// the caller in the x-request-id metadata when present. The id is added to the
+// contextual logger and forwarded to the Virium API as X-Request-ID
+func requestIDGRPC(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	requestID := ""
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if ids := md.Get("x-request-id"); len(ids) > 0 {
+			requestID = ids[0]
+		}
+	}
+	if requestID == "" {
+		requestID = uuid.NewString()
+	}
+	ctx = context.WithValue(ctx, requestIDKey{}, requestID)
+	ctx = klog.NewContext(ctx, klog.FromContext(ctx).WithValues("requestID", requestID))
+	return handler(ctx, req)
+}
+
+// requestIDFromContext returns the correlation id of the CSI call, if any
+func requestIDFromContext(ctx context.Context) string {
+	requestID, _ := ctx.Value(requestIDKey{}).(string)
+	return requestID
+}
+
 func logGRPC(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
-	klog.V(3).Infof("GRPC call: %s", info.FullMethod)
-	klog.V(5).Infof("GRPC request: %s", protosanitizer.StripSecrets(req))
+	logger := klog.FromContext(ctx)
+	logger.V(3).Info("GRPC call", "method", info.FullMethod)
+	logger.V(5).Info("GRPC request", "request", protosanitizer.StripSecrets(req))
 	resp, err := handler(ctx, req)
 	if err != nil {
-		klog.Errorf("GRPC error: %v", err)
+		logger.Error(err, "GRPC error", "method", info.FullMethod)
 	} else {
-		klog.V(5).Infof("GRPC response: %s", protosanitizer.StripSecrets(resp))
+		logger.V(5).Info("GRPC response", "response", protosanitizer.StripSecrets(resp))
 	}
 	return resp, err
 }
 
-func viriumHttpClient(method string, url string, jsonData []byte) ([]byte, error) {
-	// Step 2: Make the HTTP POST request
-	// Create custom HTTP client with timeout
-	timeout := time.Duration(300 * time.Second)
-	client := &http.Client{
-		Timeout: timeout,
+// apiError is returned by viriumHttpClient when the Virium API answers
+// with an unexpected HTTP status
+type apiError struct {
+	statusCode int
+	body       string
+	// code, message and metadata come from the {"error":"...","code":"...","metadata":{...}}
+	// envelope, when present
+	code     string
+	message  string
+	metadata map[string]string
+}
+
+// newAPIError decodes the standard Virium error envelope from a failed response body
+func newAPIError(statusCode int, body []byte) *apiError {
+	apiErr := &apiError{statusCode: statusCode, body: string(body)}
+	var envelope struct {
+		Error    string            `json:"error"`
+		Code     string            `json:"code"`
+		Metadata map[string]string `json:"metadata"`
 	}
+	if err := json.Unmarshal(body, &envelope); err == nil {
+		apiErr.code = envelope.Code
+		apiErr.message = envelope.Error
+		apiErr.metadata = envelope.Metadata
+	}
+	return apiErr
+}
 
-	authString := fmt.Sprintf("%s:%s", *api_username, *api_password)
-	authStringB64 := base64.StdEncoding.EncodeToString([]byte(authString))
-	authHeader := "Basic " + authStringB64
+func (e *apiError) Error() string {
+	msg := e.body
+	if e.message != "" {
+		msg = e.message
+	}
+	if e.statusCode == http.StatusUnauthorized || e.statusCode == http.StatusForbidden {
+		return fmt.Sprintf("API authentication failed(%d), check the api credentials: %s", e.statusCode, msg)
+	}
+	return fmt.Sprintf("API error(%d): %s", e.statusCode, msg)
+}
+
+// grpcCode maps the backend error to the closest gRPC code,
+// the envelope code wins over the HTTP status
+func (e *apiError) grpcCode() codes.Code {
+	switch e.code {
+	case "quota", "quota_exceeded":
+		return codes.ResourceExhausted
+	case "conflict", "already_exists":
+		return codes.AlreadyExists
+	case "not_found":
+		return codes.NotFound
+	}
+	if e.message == "" {
+		return codes.Internal
+	}
+	switch e.statusCode {
+	case http.StatusNotFound:
+		return codes.NotFound
+	case http.StatusConflict:
+		return codes.AlreadyExists
+	case http.StatusUnauthorized:
+		return codes.Unauthenticated
+	case http.StatusForbidden:
+		return codes.PermissionDenied
+	case http.StatusTooManyRequests, http.StatusInsufficientStorage:
+		return codes.ResourceExhausted
+	case http.StatusBadRequest:
+		return codes.InvalidArgument
+	}
+	return codes.Internal
+}
 
+// errorDomain is the google.rpc.ErrorInfo domain of backend failures
+const errorDomain = "virium.io"
+
+// errorInfo describes a backend failure carrying an envelope code, so that tooling
+// can react to e.g. quota errors without parsing the message
+func (e *apiError) errorInfo() *errdetails.ErrorInfo {
+	if e.code == "" {
+		return nil
+	}
+	metadata := map[string]string{"httpStatus": strconv.Itoa(e.statusCode)}
+	for k, v := range e.metadata {
+		metadata[k] = v
+	}
+	return &errdetails.ErrorInfo{
+		Reason:   strings.ToUpper(e.code),
+		Domain:   errorDomain,
+		Metadata: metadata,
+	}
+}
+
+// apiStatusError turns a viriumHttpClient failure into a gRPC status error,
+// keeping the backend message so it shows up in kubectl describe
+func apiStatusError(msg string, err error) error {
+	var apiErr *apiError
+	if errors.As(err, &apiErr) {
+		st := status.Newf(apiErr.grpcCode(), "%s: %v", msg, apiErr)
+		if info := apiErr.errorInfo(); info != nil {
+			if withInfo, err := st.WithDetails(info); err == nil {
+				st = withInfo
+			}
+		}
+		return st.Err()
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return status.Errorf(codes.DeadlineExceeded, "%s: %v", msg, err)
+	}
+	return status.Errorf(codes.Unavailable, "%s: %v", msg, err)
+}
+
+// isNotFound reports whether err is a Virium API 404 response or carries
+// the not_found envelope code
+func isNotFound(err error) bool {
+	var apiErr *apiError
+	return errors.As(err, &apiErr) && (apiErr.statusCode == http.StatusNotFound || apiErr.code == "not_found")
+}
+
+// newAPIHTTPClient builds the client shared by all Virium API calls,
+// with the TLS and connection pool settings given on the command line
+func newAPIHTTPClient() (*http.Client, error) {
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: *apiInsecureSkipVerify,
+	}
+	if *apiCAFile != "" {
+		caCert, err := os.ReadFile(*apiCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read api CA file %s: %v", *apiCAFile, err)
+		}
+		caPool := x509.NewCertPool()
+		if !caPool.AppendCertsFromPEM(caCert) {
+			return nil, fmt.Errorf("no valid certificate found in api CA file %s", *apiCAFile)
+		}
+		tlsConfig.RootCAs = caPool
+	}
+	if *apiCertFile != "" || *apiKeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(*apiCertFile, *apiKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load api client certificate: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	// Keep idle connections around so concurrent provisioning reuses them
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	// The environment proxy settings apply unless -api_proxy is given
+	transport.Proxy = http.ProxyFromEnvironment
+	if *apiProxy != "" {
+		proxyURL, err := url.Parse(*apiProxy)
+		if err != nil || proxyURL.Host == "" {
+			return nil, fmt.Errorf("invalid api proxy %q", *apiProxy)
+		}
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
+	transport.MaxIdleConns = *apiMaxIdleConns
+	transport.MaxIdleConnsPerHost = *apiMaxIdleConnsPerHost
+	transport.IdleConnTimeout = *apiIdleConnTimeout
+	return &http.Client{Transport: transport}, nil
+}
+
+// apiClient sends requests to the Virium API, paths are relative to the api url
+type apiClient interface {
+	// Do returns the response body and HTTP status, a status the method
+	// doesn't expect is returned as an *apiError
+	Do(ctx context.Context, method, path string, body []byte) ([]byte, int, error)
+}
+
+// httpAPIClient is the apiClient talking to the Virium API over HTTP
+type httpAPIClient struct {
+	baseURL *url.URL
+	client  *http.Client
+}
+
+// parseAPIURL validates the -apiurl flag, a missing scheme or host fails
+// at startup instead of producing malformed request URLs
+func parseAPIURL(raw string) (*url.URL, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid api url %q: %v", raw, err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("invalid api url %q: scheme must be http or https", raw)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("invalid api url %q: host is missing", raw)
+	}
+	if u.RawQuery != "" || u.Fragment != "" {
+		return nil, fmt.Errorf("invalid api url %q: query and fragment are not allowed", raw)
+	}
+	u.Path = strings.TrimRight(u.Path, "/")
+	u.RawPath = strings.TrimRight(u.RawPath, "/")
+	return u, nil
+}
+
+// endpointURL joins an api path, optionally carrying a query, to the api url
+func (c *httpAPIClient) endpointURL(path string) (string, error) {
+	ref, err := url.Parse(path)
+	if err != nil {
+		return "", fmt.Errorf("invalid api path %q: %v", path, err)
+	}
+	u := c.baseURL.JoinPath(ref.EscapedPath())
+	u.RawQuery = ref.RawQuery
+	return u.String(), nil
+}
+
+func newHTTPAPIClient(baseURL *url.URL) (*httpAPIClient, error) {
+	client, err := newAPIHTTPClient()
+	if err != nil {
+		return nil, err
+	}
+	return &httpAPIClient{baseURL: baseURL, client: client}, nil
+}
+
+func (c *httpAPIClient) Do(ctx context.Context, method, path string, body []byte) ([]byte, int, error) {
+	// Bound the call with the default timeout unless the caller already set a deadline,
+	// the deadline also bounds the total time spent retrying
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *apiTimeout)
+		defer cancel()
+	}
+
+	reqURL, err := c.endpointURL(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	for attempt := 0; ; attempt++ {
+		respBody, statusCode, retryAfter, retryable, err := sendViriumRequest(ctx, c.client, method, reqURL, body)
+		if err == nil {
+			return respBody, statusCode, nil
+		}
+		delay := retryDelay(attempt, retryAfter)
+		deadline, hasDeadline := ctx.Deadline()
+		if !retryable || attempt >= *apiMaxRetries || (hasDeadline && time.Until(deadline) < delay) {
+			apiErrorsTotal.WithLabelValues(method).Inc()
+			return nil, statusCode, err
+		}
+		klog.FromContext(ctx).V(2).Info("API request failed, retrying", "method", method, "url", reqURL, "attempt", attempt+1, "maxAttempts", *apiMaxRetries+1, "delay", delay, "err", err)
+
+		select {
+		case <-ctx.Done():
+			apiErrorsTotal.WithLabelValues(method).Inc()
+			return nil, statusCode, err
+		case <-time.After(delay):
+		}
+	}
+}
+
+// viriumHttpClient calls the Virium API at path and returns the response body
+func (d *driver) viriumHttpClient(ctx context.Context, method string, path string, jsonData []byte) ([]byte, error) {
+	body, _, err := d.api.Do(ctx, method, path, jsonData)
+	return body, err
+}
+
+// sendViriumRequest performs a single Virium API call, it reports the HTTP status, whether
+// a failure is worth retrying and the delay requested by the server if any
+func sendViriumRequest(ctx context.Context, client *http.Client, method string, url string, jsonData []byte) ([]byte, int, time.Duration, bool, error) {
 	// Build the HTTP request manually
-	httpReq, err := http.NewRequest(method, url, bytes.NewBuffer(jsonData))
-	httpReq.Header.Set("Authorization", authHeader)
+	httpReq, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(jsonData))
 	if err != nil {
-		return nil, fmt.Errorf("failed to create HTTP request: %v", err)
+		return nil, 0, 0, false, fmt.Errorf("failed to create HTTP request: %v", err)
+	}
+	if err := setAuthHeader(httpReq); err != nil {
+		return nil, 0, 0, false, err
 	}
 	httpReq.Header.Set("Content-Type", "application/json")
+	httpReq.Header.Set("User-Agent", userAgent())
+	if requestID := requestIDFromContext(ctx); requestID != "" {
+		httpReq.Header.Set("X-Request-ID", requestID)
+	}
 
-	// Send the request
+	// Send the request, connection errors are retried unless the context is done
 	resp, err := client.Do(httpReq)
 	if err != nil {
-		return nil, fmt.Errorf("failed to call API: %v", err)
+		return nil, 0, 0, ctx.Err() == nil, fmt.Errorf("failed to call API: %w", err)
 	}
 	defer resp.Body.Close()
 
 	// Read all data into memory
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return nil, err
+		return nil, resp.StatusCode, 0, ctx.Err() == nil, err
 	}
 
-	if method == "POST" {
-		// We expect HTTP 201 response
-		if resp.StatusCode != http.StatusCreated {
-			return nil, fmt.Errorf("API error(%d): %s", resp.StatusCode, string(body))
-		}
-	} else if method == "DELETE" {
+	expected := false
+	switch method {
+	case "GET":
+		// We expect HTTP 200 response
+		expected = resp.StatusCode == http.StatusOK
+	case "POST":
+		// We expect HTTP 201 response, or 200 for actions on existing objects,
+		// or 202 when the backend runs the request as a job
+		expected = resp.StatusCode == http.StatusCreated || resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusAccepted
+	case "DELETE":
 		// We expect HTTP 200 response
-		if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNoContent {
-			return nil, fmt.Errorf("API error(%d): %s", resp.StatusCode, string(body))
+		expected = resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusNoContent
+	case "PATCH":
+		// We expect HTTP 200 response with the updated object, or 202 for a job
+		expected = resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusAccepted || resp.StatusCode == http.StatusNoContent
+	default:
+		expected = true
+	}
+	if expected {
+		return body, resp.StatusCode, 0, false, nil
+	}
+
+	apiErr := newAPIError(resp.StatusCode, body)
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests, http.StatusServiceUnavailable:
+		return nil, resp.StatusCode, parseRetryAfter(resp.Header.Get("Retry-After")), true, apiErr
+	case http.StatusBadGateway, http.StatusGatewayTimeout:
+		return nil, resp.StatusCode, 0, true, apiErr
+	}
+	return nil, resp.StatusCode, 0, false, apiErr
+}
+
+// userAgent identifies the controller to the Virium api, for auditing and rate limiting
+func userAgent() string {
+	if *apiUserAgent != "" {
+		return *apiUserAgent
+	}
+	return fmt.Sprintf("virium-csi-driver-iscsi/%s (controller)", version)
+}
+
+// setAuthHeader authenticates the request with the api token when one is configured,
+// and falls back to basic auth otherwise. The token file is read on every request
+// so that a rotated secret is picked up without a restart
+func setAuthHeader(httpReq *http.Request) error {
+	token := os.Getenv("VIRIUM_API_TOKEN")
+	if *apiTokenFile != "" {
+		data, err := os.ReadFile(*apiTokenFile)
+		if err != nil {
+			return fmt.Errorf("failed to read api token file %s: %v", *apiTokenFile, err)
 		}
+		token = strings.TrimSpace(string(data))
+	}
+
+	if token == "" {
+		authString := fmt.Sprintf("%s:%s", *apiUsername, *apiPassword)
+		authStringB64 := base64.StdEncoding.EncodeToString([]byte(authString))
+		httpReq.Header.Set("Authorization", "Basic "+authStringB64)
+		return nil
+	}
+
+	if strings.EqualFold(*apiTokenHeader, "Authorization") {
+		httpReq.Header.Set("Authorization", "Bearer "+token)
+	} else {
+		httpReq.Header.Set(*apiTokenHeader, token)
+	}
+	return nil
+}
+
+// maxRetryDelay caps the exponential backoff between two api retries
+const maxRetryDelay = 30 * time.Second
+
+// retryDelay returns the exponential backoff delay with jitter for the given attempt,
+// a delay requested by the server through Retry-After takes precedence
+func retryDelay(attempt int, retryAfter time.Duration) time.Duration {
+	if retryAfter > 0 {
+		return retryAfter
+	}
+	// Doubling stops at the cap, a large -api_max_retries can't overflow the delay
+	delay := *apiRetryDelay
+	for i := 0; i < attempt && delay > 0 && delay < maxRetryDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxRetryDelay {
+		delay = maxRetryDelay
+	}
+	if delay <= 0 {
+		return 0
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// parseRetryAfter parses a Retry-After header given either in seconds or as an HTTP date
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
 	}
+	if t, err := http.ParseTime(value); err == nil {
+		return time.Until(t)
+	}
+	return 0
+}
+
+// getRequestCapacity returns the capacity to provision for the given range,
+// RequiredBytes is preferred and LimitBytes is used when it is not set
+func getRequestCapacity(capRange *csi.CapacityRange) (int64, error) {
+	required := capRange.GetRequiredBytes()
+	limit := capRange.GetLimitBytes()
+	if required < 0 || limit < 0 {
+		return 0, status.Error(codes.InvalidArgument, "Capacity Range must not be negative")
+	}
+	if required == 0 && limit == 0 {
+		return 0, status.Error(codes.InvalidArgument, "Capacity Range missing in request")
+	}
+	if limit > 0 && required > limit {
+		return 0, status.Errorf(codes.InvalidArgument, "required bytes %d exceeds limit bytes %d", required, limit)
+	}
+	if required > 0 {
+		return required, nil
+	}
+	return limit, nil
+}
 
-	return body, nil
+// isCapacityInRange reports whether an existing volume size satisfies the requested range
+func isCapacityInRange(capacity int64, capRange *csi.CapacityRange) bool {
+	if capacity < capRange.GetRequiredBytes() {
+		return false
+	}
+	if capRange.GetLimitBytes() > 0 && capacity > capRange.GetLimitBytes() {
+		return false
+	}
+	return true
+}
+
+// roundVolumeSize raises capacity to -min_volume_size and rounds it up to a
+// multiple of -volume_size_granularity, the result must still fit LimitBytes
+func roundVolumeSize(capacity int64, capRange *csi.CapacityRange) (int64, error) {
+	rounded := capacity
+	if rounded < *minVolumeSize {
+		rounded = *minVolumeSize
+	}
+	if g := *volumeSizeGranularity; g > 0 && rounded%g != 0 {
+		rounded = (rounded/g + 1) * g
+	}
+	if limit := capRange.GetLimitBytes(); limit > 0 && rounded > limit {
+		return 0, status.Errorf(codes.OutOfRange, "requested %d bytes rounds up to %d bytes, above the limit of %d bytes", capacity, rounded, limit)
+	}
+	return rounded, nil
+}
+
+// checkMaxVolumeSize rejects a capacity above the -max_volume_size cap
+func checkMaxVolumeSize(capacity int64) error {
+	if *maxVolumeSize > 0 && capacity > *maxVolumeSize {
+		return status.Errorf(codes.OutOfRange, "requested %d bytes exceeds the maximum volume size of %d bytes", capacity, *maxVolumeSize)
+	}
+	return nil
+}
+
+// iqnPattern matches the RFC 3720 iSCSI names: iqn.yyyy-mm.reversed.domain[:unique],
+// eui. followed by 16 hex digits and naa. followed by 16 or 32 hex digits. iSCSI
+// names compare case-insensitively and open-iscsi writes mixed case ones, e.g. Open-iSCSI
+var iqnPattern = regexp.MustCompile(`(?i)^(iqn\.[0-9]{4}-(0[1-9]|1[0-2])\.[a-z0-9]([a-z0-9-]*[a-z0-9])?(\.[a-z0-9]([a-z0-9-]*[a-z0-9])?)*(:[^\s]+)?|eui\.[0-9a-f]{16}|naa\.([0-9a-f]{16}|[0-9a-f]{32}))$`)
+
+// validateIQN checks a target name before it is handed to the node plugin,
+// so a malformed one fails here instead of deep in the iscsiadm login
+func validateIQN(iqn string) error {
+	if !iqnPattern.MatchString(iqn) {
+		return fmt.Errorf("invalid target IQN %q, must be an iqn., eui. or naa. name", iqn)
+	}
+	return nil
+}
+
+// nodeInitiator returns the iSCSI initiator of a node: the node ID itself when the
+// node plugin runs with its IQN as node ID, otherwise the -node_initiator_format name,
+// or defaultInitiator shared by all nodes when no format is set
+func nodeInitiator(nodeID, defaultInitiator string) (string, error) {
+	if validateIQN(nodeID) == nil {
+		return nodeID, nil
+	}
+	if *nodeInitiatorFormat == "" {
+		return defaultInitiator, nil
+	}
+	initiator := strings.ReplaceAll(*nodeInitiatorFormat, "%s", nodeID)
+	if err := validateIQN(initiator); err != nil {
+		return "", fmt.Errorf("invalid -node_initiator_format initiator: %v", err)
+	}
+	return initiator, nil
+}
+
+// isSingleNodeMode reports whether an access mode allows a single node only
+func isSingleNodeMode(mode csi.VolumeCapability_AccessMode_Mode) bool {
+	switch mode {
+	case csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+		csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY,
+		csi.VolumeCapability_AccessMode_SINGLE_NODE_SINGLE_WRITER,
+		csi.VolumeCapability_AccessMode_SINGLE_NODE_MULTI_WRITER:
+		return true
+	}
+	return false
+}
+
+// maxLUN is the highest LUN the node plugin can address
+const maxLUN = 255
+
+// validateLUN checks a LUN before it is handed to the node plugin,
+// an empty LUN is an error since LUN 0 is a real address
+func validateLUN(lun string) error {
+	if lun == "" {
+		return fmt.Errorf("LUN is missing")
+	}
+	n, err := strconv.Atoi(lun)
+	if err != nil || n < 0 || n > maxLUN {
+		return fmt.Errorf("invalid LUN %q, must be within 0..%d", lun, maxLUN)
+	}
+	return nil
+}
+
+// supportedFsTypes are the filesystems the node plugin can format,
+// an empty fsType lets the node pick its default
+var supportedFsTypes = []string{"ext2", "ext3", "ext4", "xfs"}
+
+// validateFsType checks fsType against the supported filesystems and the -extra_fstypes flag
+func validateFsType(fsType string) error {
+	if fsType == "" {
+		return nil
+	}
+	allowed := append([]string{}, supportedFsTypes...)
+	for _, t := range strings.Split(*extraFsTypes, ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			allowed = append(allowed, t)
+		}
+	}
+	for _, t := range allowed {
+		if fsType == t {
+			return nil
+		}
+	}
+	return fmt.Errorf("unsupported fsType %q, supported types are: %s", fsType, strings.Join(allowed, ", "))
+}
+
+// maxBackendNameLength is the longest volume name the Virium backend accepts
+const maxBackendNameLength = 64
+
+// backendVolumeName prefixes the CSI volume name with -volume_name_prefix and maps
+// it to the backend character set, a name too long is cut and suffixed with a hash
+// of the full name so that two CSI names never share a backend name
+func backendVolumeName(name string) string {
+	full := *volumeNamePrefix + name
+	sanitized := strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == '-' || r == '_' || r == '.' {
+			return r
+		}
+		return '-'
+	}, full)
+	if len(sanitized) <= maxBackendNameLength {
+		return sanitized
+	}
+	sum := sha256.Sum256([]byte(full))
+	suffix := hex.EncodeToString(sum[:])[:8]
+	return sanitized[:maxBackendNameLength-len(suffix)-1] + "-" + suffix
+}
+
+// Parameters that the external-provisioner reserves for itself, like secret references
+const reservedParameterPrefix = "csi.storage.k8s.io/"
+
+// knownParameters maps each StorageClass parameter understood by the driver to its validator
+var knownParameters = map[string]func(string) error{
+	"fsType":                validateFsType,
+	volCtxMkfsOptions:       validateNonEmpty,
+	volCtxTargetPort:        validatePort,
+	volCtxInterface:         validateNonEmpty,
+	paramPool:               validateNonEmpty,
+	paramQosPolicy:          validateNonEmpty,
+	volCtxDiscoveryCHAPAuth: validateBool,
+	volCtxSessionCHAPAuth:   validateBool,
+	paramExistingTarget:     validateNonEmpty,
+	paramExistingIQN:        validateIQN,
+	paramExistingLUN:        validateLUN,
+	volCtxDiscovery:         validateDiscoveryMode,
+	volCtxNoopOutInterval:   validateSeconds(0, maxNoopOutSeconds),
+	volCtxNoopOutTimeout:    validateSeconds(1, maxNoopOutSeconds),
+}
+
+// maxNoopOutSeconds bounds the iSCSI NOP-Out settings, a longer interval
+// no longer detects a dead session in a useful time
+const maxNoopOutSeconds = 3600
+
+// validateSeconds returns a validator of a whole number of seconds within min..max
+func validateSeconds(min, max int) func(string) error {
+	return func(value string) error {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < min || n > max {
+			return fmt.Errorf("must be a number of seconds within %d..%d", min, max)
+		}
+		return nil
+	}
+}
+
+// validateDiscoveryMode accepts the target lookup modes of the node connector
+func validateDiscoveryMode(value string) error {
+	if value != "sendtargets" && value != "static" {
+		return fmt.Errorf("must be sendtargets or static")
+	}
+	return nil
+}
+
+// validateBool accepts the values the node plugin parses as CHAP toggles
+func validateBool(value string) error {
+	if value != "true" && value != "false" {
+		return fmt.Errorf("must be true or false")
+	}
+	return nil
+}
+
+func validateNonEmpty(value string) error {
+	if strings.TrimSpace(value) == "" {
+		return fmt.Errorf("must not be empty")
+	}
+	return nil
+}
+
+// validateParameters checks the StorageClass parameters and reports every
+// malformed key at once. Unknown keys are only logged, unless
+// -ignore_unknown_parameters=false rejects them too
+func validateParameters(ctx context.Context, params map[string]string) error {
+	problems, unknown := checkParameters(params, knownParameters, *ignoreUnknownParameters)
+	if len(unknown) > 0 {
+		klog.FromContext(ctx).Info("Ignoring StorageClass parameters unknown to this driver version", "parameters", unknown)
+	}
+	if len(problems) > 0 {
+		return status.Errorf(codes.InvalidArgument, "invalid StorageClass parameters: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// mutableParameters maps each VolumeAttributesClass parameter that can be
+// changed on an existing volume to its validator
+var mutableParameters = map[string]func(string) error{
+	paramQosPolicy:      validateNonEmpty,
+	paramIopsLimit:      validateLimit,
+	paramBandwidthLimit: validateLimit,
+}
+
+// validateMutableParameters checks the VolumeAttributesClass parameters, unlike
+// StorageClass ones an unknown key is always rejected since it can't be applied
+func validateMutableParameters(params map[string]string) error {
+	if problems, _ := checkParameters(params, mutableParameters, false); len(problems) > 0 {
+		return status.Errorf(codes.InvalidArgument, "invalid mutable parameters: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// checkParameters returns a description of every unknown or malformed key of params,
+// in key order, and the unknown keys that allowUnknown let through
+func checkParameters(params map[string]string, known map[string]func(string) error, allowUnknown bool) (problems []string, unknown []string) {
+	keys := make([]string, 0, len(params))
+	for k := range params {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		if strings.HasPrefix(k, reservedParameterPrefix) {
+			continue
+		}
+		validate, ok := known[k]
+		if !ok {
+			if allowUnknown {
+				unknown = append(unknown, k)
+			} else {
+				problems = append(problems, fmt.Sprintf("unknown parameter %q", k))
+			}
+			continue
+		}
+		if err := validate(params[k]); err != nil {
+			problems = append(problems, fmt.Sprintf("parameter %q: %v", k, err))
+		}
+	}
+	return problems, unknown
+}
+
+// validateLimit accepts a non-negative whole number, 0 removes the limit
+func validateLimit(value string) error {
+	if _, err := parseLimit(value); err != nil {
+		return err
+	}
+	return nil
+}
+
+func parseLimit(value string) (int64, error) {
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("must be a non-negative whole number")
+	}
+	return n, nil
+}
+
+// newVolumeModifyRequest builds the backend update of validated mutable parameters,
+// a limit that isn't given is left unchanged
+func newVolumeModifyRequest(params map[string]string) VolumeModifyRequest {
+	req := VolumeModifyRequest{QosPolicy: params[paramQosPolicy]}
+	if v, ok := params[paramIopsLimit]; ok {
+		n, _ := parseLimit(v)
+		req.IopsLimit = &n
+	}
+	if v, ok := params[paramBandwidthLimit]; ok {
+		n, _ := parseLimit(v)
+		req.BandwidthLimit = &n
+	}
+	return req
+}
+
+// validatePort checks a TCP port number
+func validatePort(value string) error {
+	port, err := strconv.Atoi(value)
+	if err != nil || port < 1 || port > 65535 {
+		return fmt.Errorf("invalid port %q", value)
+	}
+	return nil
+}
+
+// normalizePortal appends the default port to a portal that lacks one.
+// The node plugin only appends a port when the portal has no colon at all,
+// which breaks IPv6 portals, so the port is always made explicit here
+func normalizePortal(portal string, defaultPort string) string {
+	if portal == "" {
+		return portal
+	}
+	if _, _, err := net.SplitHostPort(portal); err == nil {
+		return portal
+	}
+	host := strings.TrimSuffix(strings.TrimPrefix(portal, "["), "]")
+	return net.JoinHostPort(host, defaultPort)
+}
+
+// portalTopologyEntry tags the portals of a subnet with a topology segment
+type portalTopologyEntry struct {
+	subnet *net.IPNet
+	key    string
+	value  string
+}
+
+// portalTopology is the -topology_portal_map, in order
+type portalTopology []portalTopologyEntry
+
+// parsePortalTopology parses comma separated subnet=key=value entries,
+// e.g. 10.0.1.0/24=topology.virium.io/network=san-a
+func parsePortalTopology(mapping string) (portalTopology, error) {
+	var topology portalTopology
+	for _, entry := range strings.Split(mapping, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.SplitN(entry, "=", 3)
+		if len(parts) != 3 || parts[1] == "" || parts[2] == "" {
+			return nil, fmt.Errorf("invalid entry %q, must be subnet=key=value", entry)
+		}
+		_, subnet, err := net.ParseCIDR(parts[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid entry %q: %v", entry, err)
+		}
+		topology = append(topology, portalTopologyEntry{subnet: subnet, key: parts[1], value: parts[2]})
+	}
+	return topology, nil
+}
+
+// segments returns the topology segment of the first subnet holding the portal,
+// nil when none does or the portal host isn't an IP address
+func (t portalTopology) segments(portal string) map[string]string {
+	host, _, err := net.SplitHostPort(portal)
+	if err != nil {
+		host = strings.TrimSuffix(strings.TrimPrefix(portal, "["), "]")
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil
+	}
+	for _, entry := range t {
+		if entry.subnet.Contains(ip) {
+			return map[string]string{entry.key: entry.value}
+		}
+	}
+	return nil
+}
+
+// listToken is the opaque ListVolumes and ListSnapshots starting token, it resumes
+// after the last returned ID so that entries created or deleted between two pages
+// are neither skipped nor returned twice
+type listToken struct {
+	// After is the last ID of the previous page
+	After string `json:"after"`
+	// Sort is the key the backend list is ordered by
+	Sort string `json:"sort"`
+}
+
+// Sort keys of the backend lists
+const (
+	listSortVolumes   = "volume_id"
+	listSortSnapshots = "snapshot_id"
+)
+
+func encodeListToken(sortKey, after string) string {
+	data, _ := json.Marshal(listToken{After: after, Sort: sortKey})
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// parseListToken returns the ID to resume after, an empty token starts from the beginning
+func parseListToken(token, sortKey string) (string, error) {
+	if token == "" {
+		return "", nil
+	}
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return "", status.Errorf(codes.Aborted, "invalid starting token: %q", token)
+	}
+	var t listToken
+	if err := json.Unmarshal(data, &t); err != nil || t.After == "" || t.Sort != sortKey {
+		return "", status.Errorf(codes.Aborted, "invalid starting token: %q", token)
+	}
+	return t.After, nil
+}
+
+// isSupportedVolumeCapability checks an access mode can be served by an iSCSI LUN.
+// Writers on several nodes would corrupt a filesystem, they are only allowed for
+// raw block volumes where the application is expected to coordinate access
+func isSupportedVolumeCapability(ctx context.Context, c *csi.VolumeCapability) error {
+	switch mode := c.GetAccessMode().GetMode(); mode {
+	case csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER,
+		csi.VolumeCapability_AccessMode_MULTI_NODE_SINGLE_WRITER:
+		if c.GetBlock() == nil {
+			return fmt.Errorf("access mode %s is not supported for filesystem volumes", mode)
+		}
+		klog.FromContext(ctx).Info("Multi-node writer access on a raw block volume, the application must coordinate writes across nodes", "accessMode", mode)
+	case csi.VolumeCapability_AccessMode_UNKNOWN:
+		return fmt.Errorf("access mode is missing")
+	}
+	return nil
 }
 
 // isValidVolumeCapabilities validates the given VolumeCapability array is valid
-func isValidVolumeCapabilities(volCaps []*csi.VolumeCapability) error {
+func isValidVolumeCapabilities(ctx context.Context, volCaps []*csi.VolumeCapability) error {
 	if len(volCaps) == 0 {
 		return fmt.Errorf("volume capabilities missing in request")
 	}
-	/* for _, c := range volCaps {
-		if c.GetMount() != nil {
-			return fmt.Errorf("mount volume capability not supported")
+	for _, c := range volCaps {
+		if err := isSupportedVolumeCapability(ctx, c); err != nil {
+			return err
 		}
-	} */
+	}
 	return nil
 }
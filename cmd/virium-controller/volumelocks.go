@@ -0,0 +1,84 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"sync"
+)
+
+// volumeOperationAlreadyExistsFmt is the Aborted message of a call racing another one
+// on the same volume, the sidecar retries it later
+const volumeOperationAlreadyExistsFmt = "an operation with the given Volume ID %s already exists"
+
+// VolumeLocks serializes the controller operations on a volume or snapshot,
+// keyed by volumeLockKey or snapshotLockKey
+type VolumeLocks struct {
+	mu    sync.Mutex
+	locks map[string]struct{}
+}
+
+func NewVolumeLocks() *VolumeLocks {
+	return &VolumeLocks{
+		locks: map[string]struct{}{},
+	}
+}
+
+// TryAcquire takes the lock on key, it returns false when it is already held
+func (vl *VolumeLocks) TryAcquire(key string) bool {
+	vl.mu.Lock()
+	defer vl.mu.Unlock()
+	if _, held := vl.locks[key]; held {
+		return false
+	}
+	vl.locks[key] = struct{}{}
+	return true
+}
+
+func (vl *VolumeLocks) Release(key string) {
+	vl.mu.Lock()
+	defer vl.mu.Unlock()
+	delete(vl.locks, key)
+}
+
+// volumeNameLockKey is the lock key of the volume with the given backend name
+func volumeNameLockKey(name string) string {
+	return "volume/" + name
+}
+
+// volumeLockKey returns the lock key of a volume ID. Calls taking a volume ID
+// lock the same key as the CreateVolume that provisioned it, its backend name,
+// a volume missing from the volume store, like a static one, is locked by ID
+func (cs *ControllerServer) volumeLockKey(volumeID string) string {
+	if name, ok := cs.Driver.volumes.volumeName(volumeID); ok {
+		return volumeNameLockKey(name)
+	}
+	return "volume-id/" + volumeID
+}
+
+// snapshotNameLockKey is the lock key of the snapshot with the given CSI name,
+// prefixed so that a snapshot never shares a key with a volume
+func snapshotNameLockKey(name string) string {
+	return "snapshot/" + name
+}
+
+// snapshotLockKey returns the lock key of a snapshot ID, see volumeLockKey
+func (cs *ControllerServer) snapshotLockKey(snapshotID string) string {
+	if name, ok := cs.Driver.volumes.snapshotName(snapshotID); ok {
+		return snapshotNameLockKey(name)
+	}
+	return "snapshot-id/" + snapshotID
+}
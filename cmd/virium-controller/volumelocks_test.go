@@ -0,0 +1,132 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+	"sync"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestCreateVolumeConcurrentSameName(t *testing.T) {
+	backend := newFakeVolumeBackend()
+	entered := make(chan struct{})
+	unblock := make(chan struct{})
+	var once sync.Once
+	api := &fakeAPIClient{handle: func(call fakeCall) (int, interface{}) {
+		if call.method == "POST" && call.path == "/api/volumes/create" {
+			once.Do(func() { close(entered) })
+			<-unblock
+		}
+		return backend.handle(call)
+	}}
+	cs := newTestControllerServer(t, api)
+
+	first := make(chan error, 1)
+	var firstID string
+	go func() {
+		resp, err := cs.CreateVolume(context.Background(), createVolumeRequest("pvc-1", 1<<30))
+		firstID = resp.GetVolume().GetVolumeId()
+		first <- err
+	}()
+	<-entered
+
+	// Calls racing the first one are aborted, the sidecar retries them
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := cs.CreateVolume(context.Background(), createVolumeRequest("pvc-1", 1<<30))
+			if status.Code(err) != codes.Aborted {
+				t.Errorf("concurrent CreateVolume returned %v, want Aborted", err)
+			}
+		}()
+	}
+	wg.Wait()
+	close(unblock)
+	if err := <-first; err != nil {
+		t.Fatalf("CreateVolume failed: %v", err)
+	}
+
+	resp, err := cs.CreateVolume(context.Background(), createVolumeRequest("pvc-1", 1<<30))
+	if err != nil {
+		t.Fatalf("retried CreateVolume failed: %v", err)
+	}
+	if resp.GetVolume().GetVolumeId() != firstID {
+		t.Errorf("retried CreateVolume returned %s, want %s", resp.GetVolume().GetVolumeId(), firstID)
+	}
+	if n := api.count("POST", "/api/volumes/create"); n != 1 {
+		t.Errorf("backend create called %d times, want 1", n)
+	}
+}
+
+func TestVolumeLockKeys(t *testing.T) {
+	api := &fakeAPIClient{handle: func(call fakeCall) (int, interface{}) {
+		return http.StatusNotFound, map[string]string{"error": "not found", "code": "not_found"}
+	}}
+	cs := newTestControllerServer(t, api)
+	ctx := context.Background()
+	cs.Driver.volumes.putVolume(ctx, backendVolumeName("pvc-1"), "vol-1")
+	cs.Driver.volumes.putSnapshot(ctx, "snapshot-1", "snap-1", "vol-1")
+
+	// The key CreateVolume or CreateSnapshot holds for the name
+	held := []string{volumeNameLockKey(backendVolumeName("pvc-1")), snapshotNameLockKey("snapshot-1")}
+	for _, key := range held {
+		if !cs.volumeLocks.TryAcquire(key) {
+			t.Fatalf("lock %s already held", key)
+		}
+		defer cs.volumeLocks.Release(key)
+	}
+
+	calls := map[string]func() error{
+		"DeleteVolume": func() error {
+			_, err := cs.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: "vol-1"})
+			return err
+		},
+		"ControllerExpandVolume": func() error {
+			_, err := cs.ControllerExpandVolume(ctx, &csi.ControllerExpandVolumeRequest{VolumeId: "vol-1", CapacityRange: &csi.CapacityRange{RequiredBytes: 2 << 30}})
+			return err
+		},
+		"ControllerModifyVolume": func() error {
+			_, err := cs.ControllerModifyVolume(ctx, &csi.ControllerModifyVolumeRequest{VolumeId: "vol-1", MutableParameters: map[string]string{paramQosPolicy: "gold"}})
+			return err
+		},
+		"DeleteSnapshot": func() error {
+			_, err := cs.DeleteSnapshot(ctx, &csi.DeleteSnapshotRequest{SnapshotId: "snap-1"})
+			return err
+		},
+	}
+	for name, call := range calls {
+		if err := call(); status.Code(err) != codes.Aborted {
+			t.Errorf("%s while its create holds the lock returned %v, want Aborted", name, err)
+		}
+	}
+
+	// A snapshot named like a volume doesn't contend with it
+	if key := snapshotNameLockKey(backendVolumeName("pvc-1")); key == held[0] {
+		t.Errorf("snapshot and volume share the lock key %s", key)
+	}
+	if key := cs.volumeLockKey("vol-2"); key == volumeNameLockKey("vol-2") {
+		t.Errorf("unknown volume ID locked as the backend name %s", key)
+	}
+}
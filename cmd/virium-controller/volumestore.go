@@ -0,0 +1,303 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/context"
+	klog "k8s.io/klog/v2"
+)
+
+// snapshotRecord associates a snapshot with the volume it was taken from
+type snapshotRecord struct {
+	SnapshotID     string `json:"snapshot_id"`
+	SourceVolumeID string `json:"source_volume_id"`
+}
+
+// volumeStoreState is the persisted content of the volume store
+type volumeStoreState struct {
+	// Backend volume name -> backend volume ID
+	Volumes map[string]string `json:"volumes"`
+	// CSI snapshot name -> backend snapshot
+	Snapshots map[string]snapshotRecord `json:"snapshots"`
+}
+
+// volumeStore keeps the mapping between CSI names and backend IDs on disk,
+// so that retried create calls converge on the same backend objects
+type volumeStore struct {
+	mu    sync.Mutex
+	path  string
+	state volumeStoreState
+}
+
+// newVolumeStore loads the store from path, or from legacyPath while path doesn't exist yet,
+// the next save then writes it to path. A missing file starts an empty store, an unreadable
+// or corrupt one is an error, since starting empty would create duplicate backend volumes
+func newVolumeStore(path, legacyPath string) (*volumeStore, error) {
+	vs := &volumeStore{
+		path: path,
+		state: volumeStoreState{
+			Volumes:   map[string]string{},
+			Snapshots: map[string]snapshotRecord{},
+		},
+	}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) && legacyPath != "" && legacyPath != path {
+		if data, err = os.ReadFile(legacyPath); err == nil {
+			klog.Infof("loading the volume store from legacy path %s, it is moved to %s on the next write", legacyPath, path)
+			path = legacyPath
+		}
+	}
+	if os.IsNotExist(err) {
+		return vs, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read volume store %s: %v", path, err)
+	}
+	var state volumeStoreState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("failed to parse volume store %s, fix or remove it to rebuild it from the backend: %v", path, err)
+	}
+	if state.Volumes != nil {
+		vs.state.Volumes = state.Volumes
+	}
+	if state.Snapshots != nil {
+		vs.state.Snapshots = state.Snapshots
+	}
+	return vs, nil
+}
+
+// save writes the store atomically so a crash never leaves a truncated file, callers hold mu
+func (vs *volumeStore) save() error {
+	data, err := json.Marshal(vs.state)
+	if err != nil {
+		return fmt.Errorf("failed to marshal volume store: %v", err)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(vs.path), filepath.Base(vs.path)+".tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create volume store: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write volume store: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write volume store: %v", err)
+	}
+	return os.Rename(tmp.Name(), vs.path)
+}
+
+func (vs *volumeStore) volumeID(name string) (string, bool) {
+	vs.mu.Lock()
+	defer vs.mu.Unlock()
+	id, ok := vs.state.Volumes[name]
+	return id, ok
+}
+
+// volumeName returns the backend name recorded for volumeID
+func (vs *volumeStore) volumeName(volumeID string) (string, bool) {
+	vs.mu.Lock()
+	defer vs.mu.Unlock()
+	for name, id := range vs.state.Volumes {
+		if id == volumeID {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+func (vs *volumeStore) putVolume(ctx context.Context, name, volumeID string) {
+	vs.mu.Lock()
+	defer vs.mu.Unlock()
+	vs.state.Volumes[name] = volumeID
+	if err := vs.save(); err != nil {
+		klog.FromContext(ctx).Error(err, "Failed to record volume", "name", name, "volumeID", volumeID)
+	}
+}
+
+func (vs *volumeStore) removeVolume(ctx context.Context, volumeID string) {
+	vs.mu.Lock()
+	defer vs.mu.Unlock()
+	for name, id := range vs.state.Volumes {
+		if id == volumeID {
+			delete(vs.state.Volumes, name)
+		}
+	}
+	if err := vs.save(); err != nil {
+		klog.FromContext(ctx).Error(err, "Failed to remove volume", "volumeID", volumeID)
+	}
+}
+
+// snapshotName returns the CSI name recorded for snapshotID
+func (vs *volumeStore) snapshotName(snapshotID string) (string, bool) {
+	vs.mu.Lock()
+	defer vs.mu.Unlock()
+	for name, rec := range vs.state.Snapshots {
+		if rec.SnapshotID == snapshotID {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+func (vs *volumeStore) putSnapshot(ctx context.Context, name, snapshotID, sourceVolumeID string) {
+	vs.mu.Lock()
+	defer vs.mu.Unlock()
+	vs.state.Snapshots[name] = snapshotRecord{SnapshotID: snapshotID, SourceVolumeID: sourceVolumeID}
+	if err := vs.save(); err != nil {
+		klog.FromContext(ctx).Error(err, "Failed to record snapshot", "name", name, "snapshotID", snapshotID)
+	}
+}
+
+func (vs *volumeStore) removeSnapshot(ctx context.Context, snapshotID string) {
+	vs.mu.Lock()
+	defer vs.mu.Unlock()
+	for name, rec := range vs.state.Snapshots {
+		if rec.SnapshotID == snapshotID {
+			delete(vs.state.Snapshots, name)
+		}
+	}
+	if err := vs.save(); err != nil {
+		klog.FromContext(ctx).Error(err, "Failed to remove snapshot", "snapshotID", snapshotID)
+	}
+}
+
+// reconcilePageSize is the backend list page size used by reconcileVolumeStore
+const reconcilePageSize = 100
+
+// reconcileVolumeStore makes the store match the backend: it drops the entries
+// whose backend object no longer exists, recovering from a crash between a backend
+// delete and the store update, and adds back the backend objects it doesn't know,
+// recovering a store lost with its volume
+func (cs *ControllerServer) reconcileVolumeStore(ctx context.Context) error {
+	logger := klog.FromContext(ctx)
+	volumes, err := cs.allVolumes(ctx)
+	if err != nil {
+		return err
+	}
+	snapshots, err := cs.allSnapshots(ctx)
+	if err != nil {
+		return err
+	}
+
+	volumeIDs := map[string]bool{}
+	for _, vol := range volumes {
+		volumeIDs[vol.VolumeID] = true
+	}
+	snapshotIDs := map[string]bool{}
+	for _, snap := range snapshots {
+		snapshotIDs[snap.VolumeID] = true
+	}
+
+	vs := cs.Driver.volumes
+	vs.mu.Lock()
+	defer vs.mu.Unlock()
+	for name, id := range vs.state.Volumes {
+		if !volumeIDs[id] {
+			logger.V(2).Info("Volume no longer exists on the backend, forgetting it", "name", name, "volumeID", id)
+			delete(vs.state.Volumes, name)
+		}
+	}
+	for name, rec := range vs.state.Snapshots {
+		if !snapshotIDs[rec.SnapshotID] {
+			logger.V(2).Info("Snapshot no longer exists on the backend, forgetting it", "name", name, "snapshotID", rec.SnapshotID)
+			delete(vs.state.Snapshots, name)
+		}
+	}
+
+	// Backend volumes of other clusters sharing the backend don't carry our prefix,
+	// without one there is no telling them apart so nothing is imported
+	if *volumeNamePrefix == "" {
+		logger.Info("Not adding backend volumes missing from the store, -volume_name_prefix is not set")
+		return vs.save()
+	}
+	for _, vol := range volumes {
+		if vol.Name == "" || !strings.HasPrefix(vol.Name, *volumeNamePrefix) {
+			continue
+		}
+		if _, ok := vs.state.Volumes[vol.Name]; !ok {
+			logger.V(2).Info("Volume missing from the store, adding it", "name", vol.Name, "volumeID", vol.VolumeID)
+			vs.state.Volumes[vol.Name] = vol.VolumeID
+		}
+	}
+	// Snapshot names carry no prefix, a snapshot is ours when its source volume is
+	ours := map[string]bool{}
+	for _, id := range vs.state.Volumes {
+		ours[id] = true
+	}
+	for _, snap := range snapshots {
+		if snap.Name == "" || !ours[snap.SourceVolumeID] {
+			continue
+		}
+		if _, ok := vs.state.Snapshots[snap.Name]; !ok {
+			logger.V(2).Info("Snapshot missing from the store, adding it", "name", snap.Name, "snapshotID", snap.VolumeID)
+			vs.state.Snapshots[snap.Name] = snapshotRecord{SnapshotID: snap.VolumeID, SourceVolumeID: snap.SourceVolumeID}
+		}
+	}
+	return vs.save()
+}
+
+// allVolumes walks every page of the backend volume list
+func (cs *ControllerServer) allVolumes(ctx context.Context) ([]VolumeResponse, error) {
+	var all []VolumeResponse
+	after := ""
+	for {
+		page, err := cs.listVolumes(ctx, after, reconcilePageSize)
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, page...)
+		// A backend ignoring the paging parameters returns everything at once
+		if len(page) < reconcilePageSize || page[len(page)-1].VolumeID == after {
+			return all, nil
+		}
+		after = page[len(page)-1].VolumeID
+	}
+}
+
+// allSnapshots walks every page of the backend snapshot list
+func (cs *ControllerServer) allSnapshots(ctx context.Context) ([]SnapshotResponse, error) {
+	var all []SnapshotResponse
+	after := ""
+	for {
+		query := url.Values{}
+		query.Set("sort", listSortSnapshots)
+		query.Set("limit", strconv.Itoa(reconcilePageSize))
+		if after != "" {
+			query.Set("after", after)
+		}
+		page, err := cs.listSnapshots(ctx, query)
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, page...)
+		if len(page) < reconcilePageSize || page[len(page)-1].VolumeID == after {
+			return all, nil
+		}
+		after = page[len(page)-1].VolumeID
+	}
+}
@@ -0,0 +1,294 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+func TestReconcileVolumeStore(t *testing.T) {
+	setFlag(t, volumeNamePrefix, "cluster1-")
+	mock := newMockAPIClient()
+	cs := newTestControllerServer(t, mock)
+
+	// More volumes than a list page holds, so that reconcile has to walk the pages
+	count := 2*reconcilePageSize + 50
+	for i := 0; i < count; i++ {
+		body, _ := json.Marshal(VolumeRequest{Name: fmt.Sprintf("cluster1-pvc-%04d", i), Capacity: 1 << 20})
+		if _, _, err := mock.Do(context.Background(), "POST", "/api/volumes/create", body); err != nil {
+			t.Fatalf("failed to create mock volume: %v", err)
+		}
+	}
+	body, _ := json.Marshal(SnapshotRequest{Name: "snapshot-1", VolumeID: "mock-vol-000001"})
+	if _, _, err := mock.Do(context.Background(), "POST", "/api/snapshot/create", body); err != nil {
+		t.Fatalf("failed to create mock snapshot: %v", err)
+	}
+	cs.Driver.volumes.putVolume(context.Background(), "pvc-gone", "mock-vol-999999")
+	cs.Driver.volumes.putSnapshot(context.Background(), "snapshot-gone", "mock-snap-999999", "mock-vol-999999")
+
+	if err := cs.reconcileVolumeStore(context.Background()); err != nil {
+		t.Fatalf("reconcileVolumeStore failed: %v", err)
+	}
+
+	vs := cs.Driver.volumes
+	if _, ok := vs.volumeID("pvc-gone"); ok {
+		t.Errorf("volume deleted on the backend is still in the store")
+	}
+	if _, ok := vs.state.Snapshots["snapshot-gone"]; ok {
+		t.Errorf("snapshot deleted on the backend is still in the store")
+	}
+	if n := len(vs.state.Volumes); n != count {
+		t.Errorf("store holds %d volumes, want %d", n, count)
+	}
+	if id, ok := vs.volumeID(fmt.Sprintf("cluster1-pvc-%04d", count-1)); !ok || id != fmt.Sprintf("mock-vol-%06d", count) {
+		t.Errorf("volume of the last page recorded as %q, want mock-vol-%06d", id, count)
+	}
+	if rec := vs.state.Snapshots["snapshot-1"]; rec.SourceVolumeID != "mock-vol-000001" {
+		t.Errorf("snapshot recorded as %+v, want its source volume", rec)
+	}
+
+	// The rebuilt store is persisted
+	reloaded := openVolumeStore(t, vs.path, "")
+	if n := len(reloaded.state.Volumes); n != count {
+		t.Errorf("reloaded store holds %d volumes, want %d", n, count)
+	}
+}
+
+func TestReconcileVolumeStoreKeepsOtherClusters(t *testing.T) {
+	setFlag(t, volumeNamePrefix, "cluster1-")
+	mock := newMockAPIClient()
+	cs := newTestControllerServer(t, mock)
+
+	for _, name := range []string{"cluster1-pvc-1", "cluster2-pvc-1"} {
+		body, _ := json.Marshal(VolumeRequest{Name: name, Capacity: 1 << 20})
+		if _, _, err := mock.Do(context.Background(), "POST", "/api/volumes/create", body); err != nil {
+			t.Fatalf("failed to create mock volume: %v", err)
+		}
+	}
+	// mock-vol-000001 is cluster1-pvc-1, mock-vol-000002 cluster2-pvc-1
+	for name, source := range map[string]string{"snapshot-cluster1": "mock-vol-000001", "snapshot-cluster2": "mock-vol-000002"} {
+		body, _ := json.Marshal(SnapshotRequest{Name: name, VolumeID: source})
+		if _, _, err := mock.Do(context.Background(), "POST", "/api/snapshot/create", body); err != nil {
+			t.Fatalf("failed to create mock snapshot: %v", err)
+		}
+	}
+	if err := cs.reconcileVolumeStore(context.Background()); err != nil {
+		t.Fatalf("reconcileVolumeStore failed: %v", err)
+	}
+	if _, ok := cs.Driver.volumes.volumeID("cluster1-pvc-1"); !ok {
+		t.Errorf("volume of this cluster not added to the store")
+	}
+	if _, ok := cs.Driver.volumes.volumeID("cluster2-pvc-1"); ok {
+		t.Errorf("volume of another cluster added to the store")
+	}
+	if _, ok := cs.Driver.volumes.state.Snapshots["snapshot-cluster1"]; !ok {
+		t.Errorf("snapshot of this cluster not added to the store")
+	}
+	if _, ok := cs.Driver.volumes.state.Snapshots["snapshot-cluster2"]; ok {
+		t.Errorf("snapshot of another cluster added to the store")
+	}
+}
+
+func TestReconcileVolumeStoreWithoutPrefix(t *testing.T) {
+	setFlag(t, volumeNamePrefix, "")
+	mock := newMockAPIClient()
+	cs := newTestControllerServer(t, mock)
+
+	for _, name := range []string{"pvc-1", "pvc-2"} {
+		body, _ := json.Marshal(VolumeRequest{Name: name, Capacity: 1 << 20})
+		if _, _, err := mock.Do(context.Background(), "POST", "/api/volumes/create", body); err != nil {
+			t.Fatalf("failed to create mock volume: %v", err)
+		}
+	}
+	body, _ := json.Marshal(SnapshotRequest{Name: "snapshot-1", VolumeID: "mock-vol-000001"})
+	if _, _, err := mock.Do(context.Background(), "POST", "/api/snapshot/create", body); err != nil {
+		t.Fatalf("failed to create mock snapshot: %v", err)
+	}
+	cs.Driver.volumes.putVolume(context.Background(), "pvc-1", "mock-vol-000001")
+	cs.Driver.volumes.putVolume(context.Background(), "pvc-gone", "mock-vol-999999")
+
+	if err := cs.reconcileVolumeStore(context.Background()); err != nil {
+		t.Fatalf("reconcileVolumeStore failed: %v", err)
+	}
+
+	// Entries are still pruned and kept, but nothing is imported from a shared backend
+	vs := cs.Driver.volumes
+	if _, ok := vs.volumeID("pvc-gone"); ok {
+		t.Errorf("volume deleted on the backend is still in the store")
+	}
+	if _, ok := vs.volumeID("pvc-1"); !ok {
+		t.Errorf("recorded volume dropped from the store")
+	}
+	if _, ok := vs.volumeID("pvc-2"); ok {
+		t.Errorf("unprefixed backend volume added to the store")
+	}
+	if len(vs.state.Snapshots) != 0 {
+		t.Errorf("backend snapshots added to the store without a prefix: %v", vs.state.Snapshots)
+	}
+}
+
+func TestVolumeStoreMissingFile(t *testing.T) {
+	vs := openVolumeStore(t, filepath.Join(t.TempDir(), "missing", "volumes.json"), "")
+	if len(vs.state.Volumes) != 0 || len(vs.state.Snapshots) != 0 {
+		t.Errorf("store from a missing file is not empty: %+v", vs.state)
+	}
+}
+
+func TestVolumeStoreSaveRenameFailure(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "volumes.json")
+	vs := openVolumeStore(t, path, "")
+	// a non-empty directory at the store path makes the final rename fail
+	if err := os.MkdirAll(filepath.Join(path, "keep"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	vs.state.Volumes["pvc-1"] = "vol-1"
+	if err := vs.save(); err == nil {
+		t.Fatal("save succeeded although the store path is a directory")
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		if e.Name() != "volumes.json" {
+			t.Errorf("save left %s behind", e.Name())
+		}
+	}
+	if _, err := os.Stat(filepath.Join(path, "keep")); err != nil {
+		t.Errorf("store path content changed: %v", err)
+	}
+}
+
+func TestVolumeStoreSaveReplacesFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "volumes.json")
+	vs := openVolumeStore(t, path, "")
+	vs.putVolume(context.Background(), "pvc-1", "vol-1")
+	vs.putVolume(context.Background(), "pvc-2", "vol-2")
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var state volumeStoreState
+	if err := json.Unmarshal(data, &state); err != nil {
+		t.Fatalf("store file is not valid JSON: %v", err)
+	}
+	if len(state.Volumes) != 2 {
+		t.Errorf("store file volumes = %v, want pvc-1 and pvc-2", state.Volumes)
+	}
+}
+
+func TestVolumeStoreLegacyPath(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "lib", "volumes.json")
+	legacyPath := filepath.Join(dir, "run", "volumes.json")
+	writeStoreFile(t, legacyPath, `{"volumes":{"pvc-1":"vol-1"},"snapshots":{"snap-1":{"snapshot_id":"s-1","source_volume_id":"vol-1"}}}`)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	vs := openVolumeStore(t, path, legacyPath)
+	if id, ok := vs.volumeID("pvc-1"); !ok || id != "vol-1" {
+		t.Errorf("volume from the legacy path = %q, %v, want vol-1", id, ok)
+	}
+	if rec, ok := vs.state.Snapshots["snap-1"]; !ok || rec.SnapshotID != "s-1" {
+		t.Errorf("snapshot from the legacy path = %+v, %v, want s-1", rec, ok)
+	}
+
+	// the next write goes to the new path, the legacy file is left alone
+	vs.putVolume(context.Background(), "pvc-2", "vol-2")
+	reloaded := openVolumeStore(t, path, "")
+	if len(reloaded.state.Volumes) != 2 {
+		t.Errorf("store at the new path volumes = %v, want pvc-1 and pvc-2", reloaded.state.Volumes)
+	}
+	legacy := openVolumeStore(t, legacyPath, "")
+	if len(legacy.state.Volumes) != 1 {
+		t.Errorf("legacy store volumes = %v, want pvc-1 only", legacy.state.Volumes)
+	}
+}
+
+func TestVolumeStoreLegacyPathIgnored(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "volumes.json")
+	legacyPath := filepath.Join(dir, "legacy.json")
+	writeStoreFile(t, path, `{"volumes":{"pvc-1":"vol-1"}}`)
+	writeStoreFile(t, legacyPath, `{"volumes":{"pvc-2":"vol-2"}}`)
+
+	vs := openVolumeStore(t, path, legacyPath)
+	if _, ok := vs.volumeID("pvc-2"); ok {
+		t.Errorf("legacy store read although %s exists", path)
+	}
+	if _, ok := vs.volumeID("pvc-1"); !ok {
+		t.Errorf("volume missing from the store at %s", path)
+	}
+}
+
+func TestVolumeStoreCorruptFile(t *testing.T) {
+	for name, content := range map[string]string{
+		"truncated":  `{"volumes":{"pvc-1":"vol`,
+		"not json":   "volumes",
+		"wrong type": `{"volumes":["pvc-1"]}`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "volumes.json")
+			writeStoreFile(t, path, content)
+			if vs, err := newVolumeStore(path, ""); err == nil {
+				t.Errorf("corrupt store loaded without error: %+v", vs.state)
+			}
+			data, err := os.ReadFile(path)
+			if err != nil || string(data) != content {
+				t.Errorf("corrupt store file changed to %q, %v", data, err)
+			}
+		})
+	}
+}
+
+func TestVolumeStoreCorruptLegacyFile(t *testing.T) {
+	dir := t.TempDir()
+	legacyPath := filepath.Join(dir, "legacy.json")
+	writeStoreFile(t, legacyPath, `{"volumes":`)
+	if _, err := newVolumeStore(filepath.Join(dir, "volumes.json"), legacyPath); err == nil {
+		t.Error("corrupt legacy store loaded without error")
+	}
+}
+
+func openVolumeStore(t *testing.T, path, legacyPath string) *volumeStore {
+	t.Helper()
+	vs, err := newVolumeStore(path, legacyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return vs
+}
+
+func writeStoreFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
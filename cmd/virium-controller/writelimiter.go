@@ -0,0 +1,52 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/status"
+)
+
+// writeLimiter bounds the create and delete calls in flight to the Virium api,
+// a burst of provisioning queues here instead of running into the backend rate limit
+type writeLimiter struct {
+	slots chan struct{}
+}
+
+// newWriteLimiter allows max concurrent calls, none are limited when max is 0
+func newWriteLimiter(max int) *writeLimiter {
+	if max <= 0 {
+		return &writeLimiter{}
+	}
+	return &writeLimiter{slots: make(chan struct{}, max)}
+}
+
+// acquire waits for a free slot until ctx is done, the returned func releases it.
+// The slot is held across the api retries, so the calls backing off on
+// Retry-After keep the queued ones from adding to the load
+func (wl *writeLimiter) acquire(ctx context.Context) (func(), error) {
+	if wl.slots == nil {
+		return func() {}, nil
+	}
+	select {
+	case wl.slots <- struct{}{}:
+		return func() { <-wl.slots }, nil
+	case <-ctx.Done():
+		st := status.FromContextError(ctx.Err())
+		return nil, status.Errorf(st.Code(), "timed out waiting for a free Virium api write slot: %v", ctx.Err())
+	}
+}
@@ -0,0 +1,139 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestWriteLimiterBoundsCreateVolume(t *testing.T) {
+	const limit, calls = 2, 6
+	backend := newFakeVolumeBackend()
+	var mu sync.Mutex
+	inflight, peak := 0, 0
+	entered := make(chan struct{}, calls)
+	unblock := make(chan struct{})
+	api := &fakeAPIClient{handle: func(call fakeCall) (int, interface{}) {
+		if call.method == "POST" && call.path == "/api/volumes/create" {
+			mu.Lock()
+			if inflight++; inflight > peak {
+				peak = inflight
+			}
+			mu.Unlock()
+			entered <- struct{}{}
+			<-unblock
+			mu.Lock()
+			inflight--
+			mu.Unlock()
+		}
+		return backend.handle(call)
+	}}
+	cs := newTestControllerServer(t, api)
+	cs.Driver.writes = newWriteLimiter(limit)
+
+	var wg sync.WaitGroup
+	for i := 0; i < calls; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if _, err := cs.CreateVolume(context.Background(), createVolumeRequest(fmt.Sprintf("pvc-%d", i), 1<<30)); err != nil {
+				t.Errorf("CreateVolume failed: %v", err)
+			}
+		}(i)
+	}
+
+	// The calls beyond the limit wait for a slot instead of reaching the backend
+	for i := 0; i < limit; i++ {
+		<-entered
+	}
+	select {
+	case <-entered:
+		t.Errorf("more than %d creates reached the backend at once", limit)
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(unblock)
+	wg.Wait()
+
+	if peak != limit {
+		t.Errorf("peak of %d concurrent creates, want %d", peak, limit)
+	}
+	if n := api.count("POST", "/api/volumes/create"); n != calls {
+		t.Errorf("backend create called %d times, want %d", n, calls)
+	}
+}
+
+func TestWriteLimiterWaitEnds(t *testing.T) {
+	wl := newWriteLimiter(1)
+	release, err := wl.acquire(context.Background())
+	if err != nil {
+		t.Fatalf("acquire failed: %v", err)
+	}
+	defer release()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := wl.acquire(ctx); status.Code(err) != codes.DeadlineExceeded {
+		t.Errorf("acquire past the deadline returned %v, want DeadlineExceeded", err)
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	if _, err := wl.acquire(ctx); status.Code(err) != codes.Canceled {
+		t.Errorf("acquire with a cancelled request returned %v, want Canceled", err)
+	}
+}
+
+func TestWriteLimiterDeleteVolumeDeadline(t *testing.T) {
+	api := &fakeAPIClient{handle: func(call fakeCall) (int, interface{}) {
+		return http.StatusNotFound, map[string]string{"error": "not found", "code": "not_found"}
+	}}
+	cs := newTestControllerServer(t, api)
+	cs.Driver.writes = newWriteLimiter(1)
+	release, err := cs.Driver.writes.acquire(context.Background())
+	if err != nil {
+		t.Fatalf("acquire failed: %v", err)
+	}
+	defer release()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = cs.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: "vol-1"})
+	if status.Code(err) != codes.DeadlineExceeded {
+		t.Errorf("DeleteVolume without a free write slot returned %v, want DeadlineExceeded", err)
+	}
+	if n := api.count("DELETE", "/api/volumes/delete"); n != 0 {
+		t.Errorf("backend delete called %d times without a free write slot", n)
+	}
+}
+
+func TestWriteLimiterUnlimited(t *testing.T) {
+	wl := newWriteLimiter(0)
+	for i := 0; i < 100; i++ {
+		if _, err := wl.acquire(context.Background()); err != nil {
+			t.Fatalf("acquire %d of an unlimited limiter failed: %v", i, err)
+		}
+	}
+}